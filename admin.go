@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// adminTokenEnv holds the bearer token of the admin API, the API is disabled if it is not set
+const adminTokenEnv = "ADMIN_TOKEN"
+
+// resourceControllers are the running controllers by resource, the admin API replays dead letters through them
+var (
+	resourceControllersMu sync.RWMutex
+	resourceControllers   = map[string]*Controller{}
+)
+
+func registerController(resource string, c *Controller) {
+	resourceControllersMu.Lock()
+	defer resourceControllersMu.Unlock()
+	resourceControllers[resource] = c
+}
+
+func controllerFor(resource string) *Controller {
+	resourceControllersMu.RLock()
+	defer resourceControllersMu.RUnlock()
+	return resourceControllers[resource]
+}
+
+// adminRoutes adds the dead letter API to the health server, protected by the bearer token of ADMIN_TOKEN
+func adminRoutes(router *mux.Router) {
+	token := os.Getenv(adminTokenEnv)
+	if len(token) == 0 {
+		logrus.Infof("Env %s not defined, admin API disabled", adminTokenEnv)
+		return
+	}
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	admin.HandleFunc("/deadletters", listDeadLetters).Methods("GET")
+	admin.HandleFunc("/deadletters/replay", replayDeadLetters).Methods("POST")
+	admin.HandleFunc("/deadletters", discardDeadLetters).Methods("DELETE")
+	admin.HandleFunc("/deadletters/{resource}/{key:.+}/replay", replayDeadLetter).Methods("POST")
+	admin.HandleFunc("/deadletters/{resource}/{key:.+}", showDeadLetter).Methods("GET")
+	admin.HandleFunc("/deadletters/{resource}/{key:.+}", discardDeadLetter).Methods("DELETE")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func deadLetterKey(resource string, key string) string {
+	return deadLetterKeyPrefix + resource + "/" + key
+}
+
+// getDeadLetter returns a dead letter, nil if it does not exist
+func getDeadLetter(ctx context.Context, resource string, key string) (*QueueItem, error) {
+	resp, err := kvGet(ctx, deadLetterKey(resource, key))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	var item QueueItem
+	if err := json.Unmarshal(resp.Kvs[0].Value, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// replay removes a dead letter and queues its key again with fresh retries
+func replay(ctx context.Context, item QueueItem) bool {
+	c := controllerFor(item.Resource)
+	if c == nil {
+		logrus.Warnf("No controller for resource %s, keeping dead letter %s", item.Resource, item.Key)
+		return false
+	}
+	if _, err := kvDel(ctx, deadLetterKey(item.Resource, item.Key)); err != nil {
+		logrus.Warnf("Unable to remove dead letter %s from etcd cluster: %v", item.Key, err)
+		return false
+	}
+	c.logger.Infof("Replaying dead letter %s", item.Key)
+	c.enqueue(item.Key, item.Resync)
+	return true
+}
+
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	items, err := listQueueItems(r.Context(), deadLetterKeyPrefix)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if items == nil {
+		items = []QueueItem{}
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func showDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	item, err := getDeadLetter(r.Context(), vars["resource"], vars["key"])
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if item == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+func replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	item, err := getDeadLetter(r.Context(), vars["resource"], vars["key"])
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if item == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"replayed": replay(r.Context(), *item)})
+}
+
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	items, err := listQueueItems(r.Context(), deadLetterKeyPrefix)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	replayed := 0
+	for _, item := range items {
+		if replay(r.Context(), item) {
+			replayed++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed, "failed": len(items) - replayed})
+}
+
+func discardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	resp, err := kvDel(r.Context(), deadLetterKey(vars["resource"], vars["key"]))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if resp.Deleted == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	logrus.Infof("Discarded dead letter %s of %s", vars["key"], vars["resource"])
+	writeJSON(w, http.StatusOK, map[string]int64{"discarded": resp.Deleted})
+}
+
+func discardDeadLetters(w http.ResponseWriter, r *http.Request) {
+	items, err := listQueueItems(r.Context(), deadLetterKeyPrefix)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	var discarded int64
+	for _, item := range items {
+		resp, err := kvDel(r.Context(), deadLetterKey(item.Resource, item.Key))
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		discarded += resp.Deleted
+	}
+	logrus.Infof("Discarded %d dead letters", discarded)
+	writeJSON(w, http.StatusOK, map[string]int64{"discarded": discarded})
+}
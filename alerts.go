@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const twalertAPI = "/api/v1/alert-profiles"
+
+const alertProfileTemplate = "alert-profile.json"
+
+const (
+	defaultWebhookAnnotation       = "twistlock.io/alert-webhook"
+	defaultWebhookSecretAnnotation = "twistlock.io/alert-webhook-secret"
+	defaultWebhookSecretKey        = "url"
+	defaultAlertProfilePrefix      = "twistlock-controller-"
+)
+
+// alertProfiles maintains an alert profile per collection, routing the alerts of a team to its own webhook
+type alertProfiles struct {
+	prefix           string
+	annotation       string
+	secretAnnotation string
+}
+
+func newAlertProfiles(c AlertConfig) *alertProfiles {
+	a := &alertProfiles{
+		prefix:           c.ProfilePrefix,
+		annotation:       c.WebhookAnnotation,
+		secretAnnotation: c.WebhookSecretAnnotation,
+	}
+	if len(a.prefix) == 0 {
+		a.prefix = defaultAlertProfilePrefix
+	}
+	if len(a.annotation) == 0 {
+		a.annotation = defaultWebhookAnnotation
+	}
+	if len(a.secretAnnotation) == 0 {
+		a.secretAnnotation = defaultWebhookSecretAnnotation
+	}
+	return a
+}
+
+// namespaceWebhook returns the webhook URL of a namespace, either from its annotation
+// or from a Secret in the namespace referenced as <name> or <name>/<key>.
+// A missing Secret means no webhook, other lookup failures are returned, so the profile is not deleted by mistake.
+func (a *alertProfiles) namespaceWebhook(ctx context.Context, meta TemplateNamespace) (string, error) {
+	if webhook := strings.TrimSpace(meta.Annotations[a.annotation]); len(webhook) > 0 {
+		return webhook, nil
+	}
+	ref := strings.TrimSpace(meta.Annotations[a.secretAnnotation])
+	if len(ref) == 0 || clusterCache == nil || clusterCache.client == nil {
+		return "", nil
+	}
+	name, key := ref, defaultWebhookSecretKey
+	if i := strings.Index(ref, "/"); i >= 0 {
+		name, key = ref[:i], ref[i+1:]
+	}
+	secret := &apiv1.Secret{}
+	err := clusterCache.client.CoreV1().RESTClient().Get().Namespace(meta.Name).Resource("secrets").Name(name).Context(ctx).Do().Into(secret)
+	if apierrors.IsNotFound(err) {
+		logrus.Warnf("Webhook secret %s of namespace %s not found", name, meta.Name)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to get webhook secret %s of namespace %s: %v", name, meta.Name, err)
+	}
+	webhook, ok := secret.Data[key]
+	if !ok {
+		logrus.Warnf("Webhook secret %s of namespace %s has no key %s", name, meta.Name, key)
+		return "", nil
+	}
+	return strings.TrimSpace(string(webhook)), nil
+}
+
+// groupWebhook returns the webhook URL annotated on an OpenShift group, a missing group means no webhook
+func (a *alertProfiles) groupWebhook(ctx context.Context, group string) (string, error) {
+	if clusterCache == nil || clusterCache.client == nil {
+		return "", nil
+	}
+	data, err := clusterCache.client.CoreV1().RESTClient().Get().AbsPath("/apis/user.openshift.io/v1/groups", group).Context(ctx).DoRaw()
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to get group %s: %v", group, err)
+	}
+	var obj struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return "", fmt.Errorf("Unable to decode group %s: %v", group, err)
+	}
+	return strings.TrimSpace(obj.Metadata.Annotations[a.annotation]), nil
+}
+
+// profile returns the template data of the alert profile of a collection, nil if no webhook is configured.
+// Namespace webhooks take precedence over group webhooks.
+func (a *alertProfiles) profile(ctx context.Context, twcoll *TwistlockCollection) (*TwistlockAlertProfile, error) {
+	if twcoll == nil {
+		return nil, nil
+	}
+	var webhooks []string
+	for _, ns := range twcoll.Namespaces {
+		webhook, err := a.namespaceWebhook(ctx, twcoll.NamespaceMetadata[ns])
+		if err != nil {
+			return nil, err
+		}
+		if len(webhook) > 0 && !sliceContains(webhooks, webhook) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	if len(webhooks) == 0 {
+		groups := append([]string{}, twcoll.Groups...)
+		sort.Strings(groups)
+		for _, group := range groups {
+			webhook, err := a.groupWebhook(ctx, group)
+			if err != nil {
+				return nil, err
+			}
+			if len(webhook) > 0 && !sliceContains(webhooks, webhook) {
+				webhooks = append(webhooks, webhook)
+			}
+		}
+	}
+	if len(webhooks) == 0 {
+		return nil, nil
+	}
+	if len(webhooks) > 1 {
+		logrus.Warnf("Collection %s has %d different webhooks, using the first one", twcoll.Name, len(webhooks))
+	}
+	return &TwistlockAlertProfile{
+		Name:       a.prefix + twcoll.Name,
+		Collection: twcoll.Name,
+		Cluster:    twcoll.Cluster,
+		Namespaces: twcoll.Namespaces,
+		WebhookURL: webhooks[0],
+	}, nil
+}
+
+// sync creates, updates and deletes the alert profiles of the given collections,
+// the profile of a nil collection is deleted. It returns an error if the existing profiles cannot be read or a write failed.
+func (a *alertProfiles) sync(ctx context.Context, templates *templateSet, collections map[string]*TwistlockCollection) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	// without the existing profiles they would be created again
+	var existing []map[string]json.RawMessage
+	profileBytes, err := gettwAPI(ctx, twalertAPI)
+	if err != nil {
+		return err
+	}
+	if len(profileBytes) > 0 {
+		if err := json.Unmarshal(profileBytes, &existing); err != nil {
+			return fmt.Errorf("Unable to decode alert profiles: %v", err)
+		}
+	}
+	find := func(name string) map[string]json.RawMessage {
+		for _, p := range existing {
+			if objectName(p) == name {
+				return p
+			}
+		}
+		return nil
+	}
+
+	for name, twcoll := range collections {
+		profile, err := a.profile(ctx, twcoll)
+		if err != nil {
+			return err
+		}
+		current := find(a.prefix + name)
+
+		if profile == nil {
+			if current != nil {
+				logrus.Infof("Deleting alert profile of collection %s", name)
+				if err := deletetwAPI(ctx, twalertAPI, a.prefix+name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		rendered, err := templates.render(alertProfileTemplate, profile)
+		if err != nil {
+			logrus.Warnf("Unable to render alert profile of collection %s: %v", name, err)
+			continue
+		}
+		rendered["name"], _ = json.Marshal(profile.Name)
+
+		if current == nil {
+			logrus.Infof("Creating alert profile of collection %s", name)
+			data, _ := json.Marshal(rendered)
+			if err := posttwAPI(ctx, twalertAPI, string(data)); err != nil {
+				logrus.Warnf("Unable to create alert profile of collection %s: %v", name, err)
+				return err
+			}
+			continue
+		}
+		changed := false
+		for f, v := range rendered {
+			if !sameRuleField(f, current[f], v) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		logrus.Infof("Updating alert profile of collection %s", name)
+		data, err := mergeFields(current, rendered)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+		if err := modifytwAPI(ctx, twalertAPI, profile.Name, string(data)); err != nil {
+			logrus.Warnf("Unable to update alert profile of collection %s: %v", name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func sampleAlertProfile() TwistlockAlertProfile {
+	return TwistlockAlertProfile{
+		Name:       defaultAlertProfilePrefix + "sample",
+		Collection: "sample",
+		Cluster:    "cluster",
+		Namespaces: []string{"sample"},
+		WebhookURL: "https://hooks.example.com/sample",
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batchMetrics counts the events added to the batches and the console updates they were coalesced into,
+// published on /debug/vars
+var batchMetrics = expvar.NewMap("collectionBatches")
+
+// pendingCollection collects the changes of a collection until its batch is flushed
+type pendingCollection struct {
+	namespaces []string
+	// CNs of the groups referencing the collection
+	groups []string
+	first  time.Time
+	timer  *time.Timer
+	events int64
+	// events waiting for the flush of the collection
+	acks []*batchAck
+}
+
+// batchAck completes an event once the batches of all of its collections are flushed,
+// with the first error that failed one of them
+type batchAck struct {
+	mu        sync.Mutex
+	remaining int
+	err       error
+	done      func(error)
+}
+
+func (a *batchAck) flushed(err error) {
+	a.mu.Lock()
+	a.remaining--
+	if a.err == nil {
+		a.err = err
+	}
+	remaining, err := a.remaining, a.err
+	a.mu.Unlock()
+	if remaining == 0 {
+		a.done(err)
+	}
+}
+
+// errBatcherClosed completes the events that arrive after the batches were flushed on shutdown
+var errBatcherClosed = errors.New("batches already flushed on shutdown")
+
+// syncBatcher debounces the changes per collection, so a burst of RoleBindings results in one console update per collection.
+// The desired state is computed when a batch is flushed, so the batch always applies the net namespace set.
+// Events are only completed once their batches are flushed, so a failed batch is retried through the queue of its keys.
+type syncBatcher struct {
+	window   time.Duration
+	maxDelay time.Duration
+	flush    func(context.Context, *syncScope) error
+	// context of the flushes started by the timers, cancelled on shutdown
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	pending map[string]*pendingCollection
+	closed  bool
+	// flushes started by the timers
+	flushing sync.WaitGroup
+}
+
+func newSyncBatcher(c BatchConfig, flush func(context.Context, *syncScope) error) *syncBatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &syncBatcher{
+		window:   c.Window,
+		maxDelay: c.MaxDelay,
+		flush:    flush,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  map[string]*pendingCollection{},
+	}
+	if b.maxDelay < b.window {
+		b.maxDelay = 10 * b.window
+	}
+	return b
+}
+
+// add merges the collections and groups touched by an event into their batches, done is called once they are flushed.
+// Every event postpones the flush of a batch by the window, but no longer than maxDelay after its first event.
+func (b *syncBatcher) add(scope *syncScope, done func(error)) {
+	if len(scope.collections) == 0 {
+		done(nil)
+		return
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		done(errBatcherClosed)
+		return
+	}
+	ack := &batchAck{remaining: len(scope.collections), done: done}
+	now := time.Now()
+	for name, namespaces := range scope.collections {
+		batchMetrics.Add("events", 1)
+		p, ok := b.pending[name]
+		if !ok {
+			p = &pendingCollection{first: now}
+			b.pending[name] = p
+			name := name
+			p.timer = time.AfterFunc(b.window, func() { b.fire(name, p) })
+		} else {
+			delay := b.window
+			if remaining := p.first.Add(b.maxDelay).Sub(now); remaining < delay {
+				delay = remaining
+			}
+			p.timer.Reset(delay)
+		}
+		for _, ns := range namespaces {
+			if !sliceContains(p.namespaces, ns) {
+				p.namespaces = append(p.namespaces, ns)
+			}
+		}
+		p.events++
+		p.acks = append(p.acks, ack)
+	}
+	for cn, names := range scope.groups {
+		for _, name := range names {
+			if p, ok := b.pending[name]; ok && !sliceContains(p.groups, cn) {
+				p.groups = append(p.groups, cn)
+			}
+		}
+	}
+	b.mu.Unlock()
+}
+
+// fire flushes the batch of a collection, unless it was already flushed
+func (b *syncBatcher) fire(name string, p *pendingCollection) {
+	b.mu.Lock()
+	if b.pending[name] != p {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, name)
+	b.flushing.Add(1)
+	b.mu.Unlock()
+	defer b.flushing.Done()
+
+	err := b.flush(b.ctx, batchScope(name, p))
+	if err != nil {
+		logrus.Warnf("Unable to flush collection %s, its events are retried: %v", name, err)
+		batchMetrics.Add("failed", 1)
+	}
+	p.flushed(err)
+}
+
+// flushed completes the events of a batch
+func (p *pendingCollection) flushed(err error) {
+	for _, ack := range p.acks {
+		ack.flushed(err)
+	}
+}
+
+// batchScope returns the scope of a batch about to be flushed
+func batchScope(name string, p *pendingCollection) *syncScope {
+	scope := newSyncScope()
+	scope.collections[name] = p.namespaces
+	for _, cn := range p.groups {
+		scope.groups[cn] = []string{name}
+	}
+	batchMetrics.Add("batches", 1)
+	batchMetrics.Add("coalesced", p.events-1)
+	logrus.Infof("Flushing %d events of collection %s", p.events, name)
+	return scope
+}
+
+// flushAll flushes all pending batches right away and stops batching, it is called on shutdown.
+// It waits for the flushes started by the timers, which are aborted once the context is done.
+// The events of batches that could not be flushed fail, so their keys stay stored and are replayed on the next start.
+func (b *syncBatcher) flushAll(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = map[string]*pendingCollection{}
+	b.closed = true
+	b.mu.Unlock()
+
+	var failed []string
+	for name, p := range pending {
+		p.timer.Stop()
+		err := ctx.Err()
+		if err == nil {
+			err = b.flush(ctx, batchScope(name, p))
+		}
+		if err != nil {
+			logrus.Errorf("Unable to flush collection %s on shutdown: %v", name, err)
+			failed = append(failed, name)
+		}
+		p.flushed(err)
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		b.flushing.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		logrus.Warn("Aborting the running flushes, the shutdown timeout has been reached")
+		b.cancel()
+		<-flushed
+	}
+	b.cancel()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to flush the batches of collections %v", failed)
+	}
+	return nil
+}
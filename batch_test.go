@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFlush records the flushed scopes and fails the collections in failing
+type fakeFlush struct {
+	mu      sync.Mutex
+	scopes  []*syncScope
+	failing map[string]bool
+}
+
+func (f *fakeFlush) flush(ctx context.Context, scope *syncScope) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scopes = append(f.scopes, scope)
+	for name := range scope.collections {
+		if f.failing[name] {
+			return errors.New("flush failed")
+		}
+	}
+	return nil
+}
+
+// flushed returns the namespaces of each flush of a collection
+func (f *fakeFlush) flushed(name string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var flushes [][]string
+	for _, scope := range f.scopes {
+		if namespaces, ok := scope.collections[name]; ok {
+			namespaces = append([]string{}, namespaces...)
+			sort.Strings(namespaces)
+			flushes = append(flushes, namespaces)
+		}
+	}
+	return flushes
+}
+
+// testScope returns a scope of collections mapped to their namespaces
+func testScope(collections map[string][]string) *syncScope {
+	scope := newSyncScope()
+	for name, namespaces := range collections {
+		scope.collections[name] = namespaces
+	}
+	return scope
+}
+
+// waitDone returns a done function and a channel receiving its error
+func waitDone() (func(error), chan error) {
+	errs := make(chan error, 1)
+	return func(err error) { errs <- err }, errs
+}
+
+func TestSyncBatcherDebounce(t *testing.T) {
+	f := &fakeFlush{}
+	b := newSyncBatcher(BatchConfig{Window: 100 * time.Millisecond, MaxDelay: time.Second}, f.flush)
+
+	var errs []chan error
+	for _, ns := range []string{"a", "b", "a"} {
+		done, ch := waitDone()
+		b.add(testScope(map[string][]string{"c": {ns}}), done)
+		errs = append(errs, ch)
+		time.Sleep(20 * time.Millisecond)
+	}
+	// every event postponed the flush by the window
+	if flushes := f.flushed("c"); len(flushes) != 0 {
+		t.Fatalf("collection flushed before the window passed: %v", flushes)
+	}
+	for i, ch := range errs {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Errorf("event %d failed: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not completed", i)
+		}
+	}
+	if flushes := f.flushed("c"); !reflect.DeepEqual(flushes, [][]string{{"a", "b"}}) {
+		t.Errorf("got flushes %v, want one flush of a and b", flushes)
+	}
+}
+
+func TestSyncBatcherMaxDelay(t *testing.T) {
+	f := &fakeFlush{}
+	b := newSyncBatcher(BatchConfig{Window: 40 * time.Millisecond, MaxDelay: 80 * time.Millisecond}, f.flush)
+
+	// the events keep arriving within the window, the batch is flushed after maxDelay anyway
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		b.add(testScope(map[string][]string{"c": {"a"}}), func(error) {})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if flushes := f.flushed("c"); len(flushes) < 2 {
+		t.Errorf("got %d flushes within 300ms, want at least 2", len(flushes))
+	}
+	b.flushAll(context.Background())
+}
+
+func TestSyncBatcherAcks(t *testing.T) {
+	f := &fakeFlush{failing: map[string]bool{"failing": true}}
+	b := newSyncBatcher(BatchConfig{Window: 20 * time.Millisecond, MaxDelay: time.Second}, f.flush)
+
+	tests := []struct {
+		name        string
+		collections map[string][]string
+		failed      bool
+	}{
+		{name: "single collection", collections: map[string][]string{"ok": {"a"}}},
+		{name: "several collections", collections: map[string][]string{"ok": {"b"}, "other": {"b"}}},
+		{name: "one collection failed", collections: map[string][]string{"ok": {"c"}, "failing": {"c"}}, failed: true},
+	}
+	var errs []chan error
+	for _, tt := range tests {
+		done, ch := waitDone()
+		b.add(testScope(tt.collections), done)
+		errs = append(errs, ch)
+	}
+	for i, tt := range tests {
+		select {
+		case err := <-errs[i]:
+			if (err != nil) != tt.failed {
+				t.Errorf("%s: got error %v, want failed %v", tt.name, err, tt.failed)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: event not completed", tt.name)
+		}
+		// every event is completed once
+		select {
+		case <-errs[i]:
+			t.Errorf("%s: event completed twice", tt.name)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if flushes := f.flushed("ok"); !reflect.DeepEqual(flushes, [][]string{{"a", "b", "c"}}) {
+		t.Errorf("got flushes %v, want one flush of all namespaces", flushes)
+	}
+}
+
+func TestSyncBatcherFlushAll(t *testing.T) {
+	f := &fakeFlush{}
+	b := newSyncBatcher(BatchConfig{Window: time.Hour}, f.flush)
+
+	done, errs := waitDone()
+	b.add(testScope(map[string][]string{"c1": {"a"}, "c2": {"a"}}), done)
+	if err := b.flushAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("event failed: %v", err)
+		}
+	default:
+		t.Fatal("event not completed by flushAll")
+	}
+	if len(f.flushed("c1")) != 1 || len(f.flushed("c2")) != 1 {
+		t.Errorf("got flushes %v and %v, want one of each collection", f.flushed("c1"), f.flushed("c2"))
+	}
+
+	// events after the shutdown are not batched anymore
+	done, errs = waitDone()
+	b.add(testScope(map[string][]string{"c1": {"b"}}), done)
+	if err := <-errs; err != errBatcherClosed {
+		t.Errorf("got error %v after shutdown, want %v", err, errBatcherClosed)
+	}
+}
+
+func TestSyncBatcherFlushAllTimeout(t *testing.T) {
+	f := &fakeFlush{}
+	b := newSyncBatcher(BatchConfig{Window: time.Hour}, f.flush)
+
+	done, errs := waitDone()
+	b.add(testScope(map[string][]string{"c": {"a"}}), done)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.flushAll(ctx); err == nil {
+		t.Error("no error for batches that could not be flushed")
+	}
+	// the event fails, so its key stays stored and is replayed
+	if err := <-errs; err == nil {
+		t.Error("event of a batch that was not flushed succeeded")
+	}
+	if flushes := f.flushed("c"); len(flushes) != 0 {
+		t.Errorf("got flushes %v after the timeout", flushes)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -26,18 +27,26 @@ func initConfig() Config {
 	if err != nil {
 		logrus.Error(err)
 	}
+	if len(cfg.Namespaces.SyncAnnotation) == 0 {
+		cfg.Namespaces.SyncAnnotation = defaultSyncAnnotation
+	}
+	if len(cfg.Rolebindings.SyncAnnotation) == 0 {
+		cfg.Rolebindings.SyncAnnotation = defaultSyncAnnotation
+	}
 	return cfg
 }
 
-// ParseEventHandler returns the respective handler object specified in the config file.
-func ParseEventHandler(conf Config) Handler {
+// ParseEventHandler returns the handler with the given name, the default handler logs the events only
+func ParseEventHandler(conf Config, name string) Handler {
 
 	var eventHandler Handler
-	switch {
-	case len(conf.Handler.Name) > 0:
+	switch strings.ToLower(name) {
+	case "twistlock":
 		eventHandler = new(Twistlock)
-	default:
+	case "", "default":
 		eventHandler = new(Default)
+	default:
+		log.Fatalf("Unknown handler %q", name)
 	}
 	if err := eventHandler.Init(conf); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConsoleRefreshInterval = 5 * time.Minute
+	defaultConsolePageSize        = 50
+)
+
+// consoleCache is a snapshot of the console collections and groups.
+// The controller's own writes keep it up to date, changes made in the console are picked up
+// with the periodic refresh or after a failed write.
+type consoleCache struct {
+	refresh     time.Duration
+	pageSize    int
+	mu          sync.Mutex
+	collections map[string]CollectionAPI
+	groups      map[string]GroupAPI
+	fetched     time.Time
+}
+
+func newConsoleCache(c ConsoleConfig) *consoleCache {
+	cc := &consoleCache{refresh: c.RefreshInterval, pageSize: c.PageSize}
+	if cc.refresh <= 0 {
+		cc.refresh = defaultConsoleRefreshInterval
+	}
+	if cc.pageSize <= 0 {
+		cc.pageSize = defaultConsolePageSize
+	}
+	return cc
+}
+
+// getPaged returns all objects of a list endpoint, fetched in pages of the given size.
+// Consoles without pagination return the whole list with the first page.
+func getPaged(ctx context.Context, endpoint string, pageSize int) ([]json.RawMessage, error) {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	var items []json.RawMessage
+	for offset := 0; ; offset += pageSize {
+		body, err := gettwAPI(ctx, fmt.Sprintf("%s%soffset=%d&limit=%d", endpoint, sep, offset, pageSize))
+		if err != nil {
+			return nil, err
+		}
+		var page []json.RawMessage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("Unable to decode %s: %v", endpoint, err)
+		}
+		// the offset is ignored if the first item comes back again
+		if offset > 0 && len(page) > 0 && len(items) > 0 && string(page[0]) == string(items[0]) {
+			return items, nil
+		}
+		items = append(items, page...)
+		if len(page) < pageSize || offset == 0 && len(page) > pageSize {
+			return items, nil
+		}
+	}
+}
+
+// load fetches all collections and groups, the caller holds the lock
+func (cc *consoleCache) load(ctx context.Context) error {
+	collItems, err := getPaged(ctx, twcollAPI, cc.pageSize)
+	if err != nil {
+		return err
+	}
+	groupItems, err := getPaged(ctx, twgrpAPI, cc.pageSize)
+	if err != nil {
+		return err
+	}
+	collections := map[string]CollectionAPI{}
+	for _, item := range collItems {
+		var coll CollectionAPI
+		if err := json.Unmarshal(item, &coll); err != nil {
+			return err
+		}
+		collections[coll.Name] = coll
+	}
+	groups := map[string]GroupAPI{}
+	for _, item := range groupItems {
+		var group GroupAPI
+		if err := json.Unmarshal(item, &group); err != nil {
+			return err
+		}
+		groups[group.GroupName] = group
+	}
+	cc.collections = collections
+	cc.groups = groups
+	cc.fetched = time.Now()
+	logrus.Infof("Console cache refreshed with %d collections and %d groups", len(collections), len(groups))
+	return nil
+}
+
+// snapshot returns the cached collections and groups, refreshing them first if they are too old
+func (cc *consoleCache) snapshot(ctx context.Context) ([]CollectionAPI, []GroupAPI, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.fetched.IsZero() || time.Since(cc.fetched) > cc.refresh {
+		if err := cc.load(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	collections := make([]CollectionAPI, 0, len(cc.collections))
+	for _, coll := range cc.collections {
+		collections = append(collections, coll)
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+	groups := make([]GroupAPI, 0, len(cc.groups))
+	for _, group := range cc.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].GroupName < groups[j].GroupName })
+	return collections, groups, nil
+}
+
+// invalidate makes the next snapshot fetch the console objects again, e.g. after a conflicting write
+func (cc *consoleCache) invalidate() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.fetched = time.Time{}
+}
+
+// storeCollection records a collection as written to the console
+func (cc *consoleCache) storeCollection(data []byte) {
+	var coll CollectionAPI
+	if err := json.Unmarshal(data, &coll); err != nil {
+		cc.invalidate()
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.collections != nil {
+		cc.collections[coll.Name] = coll
+	}
+}
+
+func (cc *consoleCache) removeCollection(name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.collections, name)
+}
+
+// storeGroup records a group as written to the console
+func (cc *consoleCache) storeGroup(data []byte) {
+	var group GroupAPI
+	if err := json.Unmarshal(data, &group); err != nil {
+		cc.invalidate()
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.groups != nil {
+		cc.groups[group.GroupName] = group
+	}
+}
+
+func (cc *consoleCache) removeGroup(name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.groups, name)
+}
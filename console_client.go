@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRequestsPerSecond = 10
+	defaultRequestRetries    = 5
+	defaultMinBackoff        = 500 * time.Millisecond
+	defaultMaxBackoff        = 30 * time.Second
+	defaultBreakerThreshold  = 5
+	defaultBreakerTimeout    = 30 * time.Second
+	// Retry-After values above maxRetryAfter are capped
+	maxRetryAfter = 5 * time.Minute
+	// interval in which paused workers check whether the probe of the open circuit breaker succeeded
+	probeInterval = time.Second
+)
+
+// consoleUnavailableError is returned when the console cannot be reached, even after retrying.
+// It is temporary, the controller keeps the affected objects queued until the console is back.
+type consoleUnavailableError struct {
+	reason string
+	// delay the console asked for with Retry-After
+	retryAfter time.Duration
+}
+
+func (e *consoleUnavailableError) Error() string {
+	return "Twistlock console unavailable: " + e.reason
+}
+
+// Temporary marks the error as temporary
+func (e *consoleUnavailableError) Temporary() bool {
+	return true
+}
+
+// RetryAfter returns the delay the console asked for, 0 if it did not ask for one
+func (e *consoleUnavailableError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// consoleClient sends the requests to the console, limiting their rate and retrying failed ones
+type consoleClient struct {
+	http       *http.Client
+	limiter    *rate.Limiter
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	breaker    *circuitBreaker
+}
+
+// twClient is replaced with the configured client by the Twistlock handler
+var twClient = newConsoleClient(ConsoleConfig{})
+
+func newConsoleClient(c ConsoleConfig) *consoleClient {
+	rps := c.RequestsPerSecond
+	if rps <= 0 {
+		rps = defaultRequestsPerSecond
+	}
+	burst := c.Burst
+	if burst <= 0 {
+		burst = int(rps)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	cc := &consoleClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			Timeout: time.Minute,
+		},
+		limiter:    rate.NewLimiter(rate.Limit(rps), burst),
+		retries:    c.Retries,
+		minBackoff: c.MinBackoff,
+		maxBackoff: c.MaxBackoff,
+		breaker:    newCircuitBreaker(c.BreakerThreshold, c.BreakerTimeout),
+	}
+	if cc.retries <= 0 {
+		cc.retries = defaultRequestRetries
+	}
+	if cc.minBackoff <= 0 {
+		cc.minBackoff = defaultMinBackoff
+	}
+	if cc.maxBackoff < cc.minBackoff {
+		cc.maxBackoff = defaultMaxBackoff
+	}
+	return cc
+}
+
+// idempotent reports whether a request can be sent again without changing its outcome
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a request should be retried after the given status.
+// Rejected requests are always retried, other failures only if the request is idempotent:
+// a POST may have created the object even though it failed.
+func retryable(method string, status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500 && idempotent(method)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header given in seconds or as HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	}
+	switch {
+	case delay < 0:
+		// a date in the past allows to retry right away
+		delay = 0
+	case delay > maxRetryAfter:
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
+// backoff returns the jittered exponential delay before the given retry
+func (cc *consoleClient) backoff(attempt int) time.Duration {
+	delay := cc.minBackoff << uint(attempt)
+	if delay <= 0 || delay > cc.maxBackoff {
+		delay = cc.maxBackoff
+	}
+	// full jitter, so controllers sharing a console do not retry in lockstep
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// do sends a request to the console and returns the status and body of the response.
+// 429 responses are retried, connection errors and 5xx responses only for idempotent requests.
+// An error is returned if the console stays unavailable or a POST failed, the caller checks whether the object was created.
+// Responses with a Retry-After header are not retried, the returned error carries the delay.
+// A cancelled context aborts the request and the retries.
+func (cc *consoleClient) do(ctx context.Context, method string, endpoint string, payload string) (int, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		ok, probe := cc.breaker.admit()
+		if !ok {
+			return 0, nil, &consoleUnavailableError{reason: "circuit breaker is open"}
+		}
+		if err := cc.limiter.Wait(ctx); err != nil {
+			if probe {
+				cc.breaker.release()
+			}
+			return 0, nil, err
+		}
+
+		var body io.Reader
+		if len(payload) > 0 {
+			body = strings.NewReader(payload)
+		}
+		req, err := http.NewRequest(method, twc.Host+endpoint, body)
+		if err != nil {
+			if probe {
+				cc.breaker.release()
+			}
+			return 0, nil, fmt.Errorf("Unable to generate request to %s%s: %v", twc.Host, endpoint, err)
+		}
+		req = req.WithContext(ctx)
+		req.SetBasicAuth(twc.User, twc.Password)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "twistlock-controller")
+
+		var status int
+		var data []byte
+		var retryAfter time.Duration
+		resp, err := cc.http.Do(req)
+		if err == nil {
+			status = resp.StatusCode
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			data, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		logrus.Infof("Method: %s, Request: %s, Response: %d, Error: %v", req.Method, req.URL, status, err)
+		// an aborted request says nothing about the console
+		if ctx.Err() != nil {
+			if probe {
+				cc.breaker.release()
+			}
+			return 0, nil, ctx.Err()
+		}
+
+		retry := idempotent(method)
+		if err == nil {
+			if status < 500 && status != http.StatusTooManyRequests {
+				cc.breaker.success()
+				return status, data, nil
+			}
+			retry = retryable(method, status)
+		}
+		cc.breaker.failure()
+		reason := fmt.Sprintf("%s %s returned status %d", method, endpoint, status)
+		if err != nil {
+			reason = fmt.Sprintf("%s %s failed: %v", method, endpoint, err)
+		}
+		// the caller may hold the locks of its objects, a delay asked for with Retry-After
+		// is not waited for here but by requeueing the objects
+		if !retry || retryAfter > 0 || attempt >= cc.retries || cc.breaker.remaining() > 0 {
+			return status, data, &consoleUnavailableError{reason: reason, retryAfter: retryAfter}
+		}
+		delay := cc.backoff(attempt)
+		logrus.Warnf("%s, retrying in %s", reason, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// circuitBreaker stops the requests to the console after consecutive failures.
+// After the timeout a single request is let through as probe, the breaker stays open until the probe succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	timeout   time.Duration
+	failures  int
+	openedAt  time.Time
+	// a probe is in flight, the other requests still fail
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, timeout time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if timeout <= 0 {
+		timeout = defaultBreakerTimeout
+	}
+	return &circuitBreaker{threshold: threshold, timeout: timeout}
+}
+
+// remaining returns how long the breaker stays open, 0 if requests are let through.
+// While the probe is in flight it returns probeInterval, the time to check again.
+func (b *circuitBreaker) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return 0
+	}
+	if d := time.Until(b.openedAt.Add(b.timeout)); d > 0 {
+		return d
+	}
+	if b.probing {
+		return probeInterval
+	}
+	return 0
+}
+
+// allow reports whether a request may be sent, the first request after the timeout is the probe
+func (b *circuitBreaker) allow() bool {
+	ok, _ := b.admit()
+	return ok
+}
+
+// admit reports whether a request may be sent and whether it is the probe
+func (b *circuitBreaker) admit() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if b.probing || time.Now().Before(b.openedAt.Add(b.timeout)) {
+		return false, false
+	}
+	logrus.Info("Circuit breaker timeout passed, probing the Twistlock console")
+	b.probing = true
+	return true, true
+}
+
+// release lets another request probe the console, the probe was aborted before the console answered
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		logrus.Info("Twistlock console is available again, closing circuit breaker")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			logrus.Warnf("Twistlock console failed %d times, opening circuit breaker for %s", b.failures, b.timeout)
+		} else if b.probing {
+			logrus.Warnf("Twistlock console probe failed, opening circuit breaker for %s", b.timeout)
+		}
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// isTemporary reports whether an error is expected to go away when retried later
+func isTemporary(err error) bool {
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// retryDelay returns the delay before an object failing with a temporary error is retried,
+// the delay asked for by the console if it is longer than temporaryRetryDelay
+func retryDelay(err error) time.Duration {
+	if ra, ok := err.(interface{ RetryAfter() time.Duration }); ok && ra.RetryAfter() > temporaryRetryDelay {
+		return ra.RetryAfter()
+	}
+	return temporaryRetryDelay
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{name: "missing", value: "", min: 0, max: 0},
+		{name: "seconds", value: "30", min: 30 * time.Second, max: 30 * time.Second},
+		{name: "seconds with spaces", value: " 2 ", min: 2 * time.Second, max: 2 * time.Second},
+		{name: "seconds capped", value: "3600", min: maxRetryAfter, max: maxRetryAfter},
+		{name: "date", value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute},
+		{name: "date capped", value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: maxRetryAfter, max: maxRetryAfter},
+		{name: "date in the past", value: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "invalid", value: "soon", min: 0, max: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := parseRetryAfter(tt.value); d < tt.min || d > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cc := newConsoleClient(ConsoleConfig{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 0, max: 100 * time.Millisecond},
+		{attempt: 1, max: 200 * time.Millisecond},
+		{attempt: 3, max: 800 * time.Millisecond},
+		{attempt: 4, max: time.Second},
+		// the shift overflows
+		{attempt: 80, max: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := cc.backoff(tt.attempt); d <= 0 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want between 0 and %s", tt.attempt, d, tt.max)
+			}
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls string // f: failure, s: success
+		open  bool
+	}{
+		{name: "no calls", calls: "", open: false},
+		{name: "below threshold", calls: "ff", open: false},
+		{name: "threshold reached", calls: "fff", open: true},
+		{name: "success resets", calls: "ffsff", open: false},
+		{name: "success closes", calls: "ffffs", open: false},
+		{name: "failures after threshold", calls: "fffff", open: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, time.Minute)
+			for _, c := range tt.calls {
+				if c == 'f' {
+					b.failure()
+				} else {
+					b.success()
+				}
+			}
+			if b.allow() == tt.open {
+				t.Errorf("allow() = %v, want %v", b.allow(), !tt.open)
+			}
+			if open := b.remaining() > 0; open != tt.open {
+				t.Errorf("remaining() = %s, want open %v", b.remaining(), tt.open)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTimeout(t *testing.T) {
+	b := newCircuitBreaker(1, 20*time.Millisecond)
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker is closed after reaching the threshold")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker is still open after the timeout")
+	}
+	// the first request after the timeout fails, the breaker opens again
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker is closed after failing again")
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	b := newCircuitBreaker(1, 20*time.Millisecond)
+	b.failure()
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("probe not let through after the timeout")
+	}
+	if b.allow() {
+		t.Fatal("second request let through while the probe is in flight")
+	}
+	if d := b.remaining(); d != probeInterval {
+		t.Errorf("remaining() = %s while probing, want %s", d, probeInterval)
+	}
+	// an aborted probe lets the next request probe the console
+	b.release()
+	if !b.allow() {
+		t.Fatal("no new probe let through after the probe was released")
+	}
+	b.success()
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatal("breaker still open after the probe succeeded")
+		}
+	}
+	if d := b.remaining(); d != 0 {
+		t.Errorf("remaining() = %s after the probe succeeded, want 0", d)
+	}
+}
+
+func TestConsoleClientDo(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		statuses  []int
+		status    int
+		requests  int
+		temporary bool
+	}{
+		{name: "success", statuses: []int{200}, status: 200, requests: 1},
+		{name: "rejected is not retried", statuses: []int{409}, status: 409, requests: 1},
+		{name: "retried until success", statuses: []int{503, 429, 200}, status: 200, requests: 3},
+		{name: "unavailable after retries", statuses: []int{500, 500, 500}, status: 500, requests: 3, temporary: true},
+		{name: "post retried when rejected", method: "POST", statuses: []int{429, 201}, status: 201, requests: 2},
+		{name: "post not retried after server error", method: "POST", statuses: []int{502, 201}, status: 502, requests: 1, temporary: true},
+		{name: "put retried after server error", method: "PUT", statuses: []int{502, 200}, status: 200, requests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[requests])
+				requests++
+			}))
+			defer srv.Close()
+			twc = &TwistlockConfig{Host: srv.URL}
+			cc := newConsoleClient(ConsoleConfig{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RequestsPerSecond: 1000})
+
+			method := tt.method
+			if len(method) == 0 {
+				method = "GET"
+			}
+			status, _, err := cc.do(context.Background(), method, "/api", "")
+			if isTemporary(err) != tt.temporary {
+				t.Errorf("got error %v, want temporary %v", err, tt.temporary)
+			}
+			if !tt.temporary && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("got status %d, want %d", status, tt.status)
+			}
+			if requests != tt.requests {
+				t.Errorf("got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestConsoleClientRetryAfter(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	twc = &TwistlockConfig{Host: srv.URL}
+	cc := newConsoleClient(ConsoleConfig{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RequestsPerSecond: 1000})
+
+	// the delay is not waited for while the caller holds its locks
+	start := time.Now()
+	_, _, err := cc.do(context.Background(), "GET", "/api", "")
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("request took %s", d)
+	}
+	if !isTemporary(err) {
+		t.Fatalf("got error %v, want temporary error", err)
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+	if d := retryDelay(err); d != 30*time.Second {
+		t.Errorf("retryDelay() = %s, want 30s", d)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGetPaged(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    int
+		pageSize int
+		// whether the fake console honours offset and limit
+		offset, limit bool
+		requests      int
+	}{
+		{name: "empty", total: 0, pageSize: 3, offset: true, limit: true, requests: 1},
+		{name: "single short page", total: 2, pageSize: 3, offset: true, limit: true, requests: 1},
+		{name: "last page short", total: 7, pageSize: 3, offset: true, limit: true, requests: 3},
+		{name: "exact multiple", total: 6, pageSize: 3, offset: true, limit: true, requests: 3},
+		{name: "limit ignored", total: 7, pageSize: 3, offset: true, limit: false, requests: 1},
+		{name: "offset ignored", total: 7, pageSize: 3, offset: false, limit: true, requests: 2},
+		{name: "offset ignored, single full page", total: 3, pageSize: 3, offset: false, limit: true, requests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.URL.Query().Get("namespaces") != "ns" {
+					t.Errorf("query of the endpoint lost: %s", r.URL.RawQuery)
+				}
+				offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+				limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+				if !tt.offset {
+					offset = 0
+				}
+				if !tt.limit {
+					limit = tt.total
+				}
+				page := []string{}
+				for i := offset; i < tt.total && i < offset+limit; i++ {
+					page = append(page, fmt.Sprintf("item-%d", i))
+				}
+				json.NewEncoder(w).Encode(page)
+			}))
+			defer srv.Close()
+			twc = &TwistlockConfig{Host: srv.URL}
+			twClient = newConsoleClient(ConsoleConfig{})
+
+			items, err := getPaged(context.Background(), "/api?namespaces=ns", tt.pageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.total
+			if !tt.offset && tt.total > tt.pageSize {
+				want = tt.pageSize
+			}
+			if len(items) != want {
+				t.Errorf("got %d items, want %d", len(items), want)
+			}
+			for i, item := range items {
+				if string(item) != fmt.Sprintf("%q", fmt.Sprintf("item-%d", i)) {
+					t.Errorf("item %d is %s", i, item)
+				}
+			}
+			if requests != tt.requests {
+				t.Errorf("got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestGetPagedError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	twc = &TwistlockConfig{Host: srv.URL}
+	twClient = newConsoleClient(ConsoleConfig{})
+
+	if _, err := getPaged(context.Background(), "/api", 3); err == nil {
+		t.Error("expected an error for a forbidden page")
+	}
+}
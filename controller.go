@@ -1,324 +1,339 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	appsv1 "k8s.io/api/apps/v1"
-	apiv1 "k8s.io/api/core/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 )
 
-// Start prepares watchers and run their controllers, then waits for process termination signals
-func startController(conf Config) {
+// Start prepares watchers and run their controllers until the context is cancelled, then drains the work in process.
+// It returns an error if the work could not be completed within the shutdown timeout.
+func startController(ctx context.Context, conf Config) error {
 	clientset, err := getClient()
 	if err != nil {
 		panic(err.Error())
 	}
 
-	if conf.Resources.Pod {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.CoreV1().Pods("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.CoreV1().Pods("").Watch(options)
-				},
-			},
-			&apiv1.Pod{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "pod")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "pod")
-	}
-
-	if conf.Resources.Deployment {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.AppsV1().Deployments("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.AppsV1().Deployments("").Watch(options)
-				},
-			},
-			&appsv1.Deployment{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "deployment")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "deployment")
-	}
-
-	if conf.Resources.Replicationcontroller {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.CoreV1().ReplicationControllers("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.CoreV1().ReplicationControllers("").Watch(options)
-				},
-			},
-			&apiv1.ReplicationController{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "replicationcontroller")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "replicationcontroller")
-	}
-
-	if conf.Resources.Replicaset {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.AppsV1().ReplicaSets("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.AppsV1().ReplicaSets("").Watch(options)
-				},
-			},
-			&appsv1.ReplicaSet{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "replicaset")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "replicaset")
-	}
-
-	if conf.Resources.Daemonset {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.AppsV1().DaemonSets("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.AppsV1().DaemonSets("").Watch(options)
-				},
-			},
-			&appsv1.DaemonSet{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "daemonset")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "daemonset")
-	}
-
-	if conf.Resources.Services {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.CoreV1().Services("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.CoreV1().Services("").Watch(options)
-				},
-			},
-			&apiv1.Service{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "service")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "service")
-	}
-
-	if conf.Resources.Secret {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.CoreV1().Secrets("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.CoreV1().Secrets("").Watch(options)
-				},
-			},
-			&apiv1.Secret{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "secret")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "secret")
-	}
-
-	if conf.Resources.Configmap {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.CoreV1().ConfigMaps("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.CoreV1().ConfigMaps("").Watch(options)
-				},
-			},
-			&apiv1.ConfigMap{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "configmap")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "configmap")
-	}
-
-	if conf.Resources.Rolebinding {
-		informer := cache.NewSharedIndexInformer(
-			&cache.ListWatch{
-				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-					return clientset.RbacV1().RoleBindings("").List(options)
-				},
-				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-					return clientset.RbacV1().RoleBindings("").Watch(options)
-				},
-			},
-			&rbacv1.RoleBinding{},
-			0, //Skip resync
-			cache.Indexers{},
-		)
-
-		eventHandler := ParseEventHandler(conf)
-		c := newResourceController(clientset, eventHandler, informer, "rolebinding")
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-
-		go c.Run(stopCh, "rolebinding")
-	}
-
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGTERM)
-	signal.Notify(sigterm, syscall.SIGINT)
-	<-sigterm
+	nsFilter, err := newNamespaceFilter(conf.Namespaces)
+	if err != nil {
+		logrus.Fatalf("Invalid namespace selection: %v", err)
+	}
+	rbFilter, err := newBindingFilter(conf.Rolebindings)
+	if err != nil {
+		logrus.Fatalf("Invalid rolebinding selection: %v", err)
+	}
+	// the informers stop with the context, their caches stay readable while the work is drained
+	stopCh := ctx.Done()
+	nsInformer := newNamespaceInformer(clientset)
+	go nsInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, nsInformer.HasSynced) {
+		logrus.Fatal("Timed out waiting for namespace cache to sync")
+	}
+	nsFilter.lister = listersv1.NewNamespaceLister(nsInformer.GetIndexer())
+
+	dynamicClient, err := getDynamicClient()
+	if err != nil {
+		panic(err.Error())
+	}
+	registry := newInformerRegistry(clientset, dynamicClient)
+
+	handlers := map[string]Handler{}
+	var controllers []*Controller
+	for _, res := range conf.Resources {
+		gvr := res.GroupVersionResource()
+		informer, err := registry.informer(res)
+		if err != nil {
+			logrus.Fatalf("Unable to watch %s: %v", res, err)
+		}
+
+		if gvr == rolebindingResource {
+			clusterCache = &ClusterCache{
+				client:       clientset,
+				namespaces:   nsFilter.lister,
+				rolebindings: rbaclisters.NewRoleBindingLister(informer.GetIndexer()),
+				bindings:     informer.GetIndexer(),
+				nsFilter:     nsFilter,
+				rbFilter:     rbFilter,
+			}
+		}
+
+		// resources sharing a handler share its instance
+		name := res.Handler
+		if len(name) == 0 {
+			name = conf.Handler.Name
+		}
+		eventHandler, ok := handlers[name]
+		if !ok {
+			eventHandler = ParseEventHandler(conf, name)
+			handlers[name] = eventHandler
+		}
+		if h, ok := eventHandler.(IndexingHandler); ok && gvr == rolebindingResource {
+			if err := informer.AddIndexers(h.Indexers()); err != nil {
+				logrus.Warnf("Unable to index %s: %v", res, err)
+			}
+		}
+		c := newResourceController(clientset, eventHandler, informer, res.String(), nsFilter, rbFilter)
+		c.workers = res.Workers
+		registerController(res.String(), c)
+		// keys pending before a restart are queued before the informer adds new events
+		c.replay(ctx)
+		controllers = append(controllers, c)
+
+		if gvr != rolebindingResource {
+			continue
+		}
+		nsFilter.watchNamespaces(nsInformer, c)
+		if conf.Collections.Scoping.NodeHosts {
+			nodeInformer := newNodeInformer(clientset)
+			nodeAnnotation := conf.Collections.Scoping.NodeSelectorAnnotation
+			if len(nodeAnnotation) == 0 {
+				nodeAnnotation = defaultNodeSelectorAnnotation
+			}
+			go nodeInformer.Run(stopCh)
+			if !cache.WaitForCacheSync(stopCh, nodeInformer.HasSynced) {
+				logrus.Fatal("Timed out waiting for node cache to sync")
+			}
+			clusterCache.nodes = listersv1.NewNodeLister(nodeInformer.GetIndexer())
+			nsFilter.watchNodes(nodeInformer, nodeAnnotation, c)
+		}
+	}
+
+	// the keys are processed with their own context, so they are not aborted as soon as the shutdown starts
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	registry.start(stopCh)
+	var wg sync.WaitGroup
+	for _, c := range controllers {
+		wg.Add(1)
+		go func(c *Controller) {
+			defer wg.Done()
+			c.Run(ctx, workCtx)
+		}(c)
+	}
+	<-ctx.Done()
+
+	timeout := conf.Shutdown.Timeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	logrus.Infof("Shutting down, draining the work in process for up to %s", timeout)
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	var drainErr error
+	select {
+	case <-drained:
+	case <-deadline.Done():
+		drainErr = fmt.Errorf("Shutdown timeout of %s exceeded, the keys in process are replayed on the next start", timeout)
+		cancelWork()
+		<-drained
+	}
+	// work held in memory by the handlers is completed with the time left
+	for name, h := range handlers {
+		sh, ok := h.(ShutdownHandler)
+		if !ok {
+			continue
+		}
+		if herr := sh.Shutdown(deadline); herr != nil {
+			logrus.Errorf("Unable to shut down handler %s: %v", name, herr)
+			if drainErr == nil {
+				drainErr = herr
+			}
+		}
+	}
+	return drainErr
 }
 
-func newResourceController(client kubernetes.Interface, eventHandler Handler, informer cache.SharedIndexInformer, resourceType string) *Controller {
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	var newEvent Event
-	var err error
+func newResourceController(client kubernetes.Interface, eventHandler Handler, informer cache.SharedIndexInformer, resourceType string, nsFilter *namespaceFilter, rbFilter *bindingFilter) *Controller {
+	logger := logrus.WithField("resource", resourceType)
+	c := &Controller{
+		logger:       logger,
+		resource:     resourceType,
+		clientset:    client,
+		informer:     informer,
+		queue:        newPersistentQueue(resourceType),
+		eventHandler: eventHandler,
+		nsFilter:     nsFilter,
+		rbFilter:     rbFilter,
+		state:        map[string]interface{}{},
+		resync:       map[string]bool{},
+	}
+	// the queue only holds keys, the current state is read from the informer cache when the key is processed,
+	// so several events of an object are merged into one
+	enqueue := func(obj interface{}, action string) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			logger.Warnf("Unable to get key of %s object: %v", action, err)
+			return
+		}
+		logger.Infof("Processing %s to %v: %s", action, resourceType, key)
+		c.enqueue(key, false)
+	}
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			newEvent.key, err = cache.MetaNamespaceKeyFunc(obj)
-			newEvent.eventType = "create"
-			newEvent.resourceType = resourceType
-			logrus.WithField("resource", resourceType).Infof("Processing add to %v: %s", resourceType, newEvent.key)
-			if err == nil {
-				queue.Add(newEvent)
-			}
+			enqueue(obj, "add")
 		},
 		UpdateFunc: func(old, new interface{}) {
-			newRoleb := new.(*rbacv1.RoleBinding)
-			oldRoleb := old.(*rbacv1.RoleBinding)
-			if newRoleb.ResourceVersion != oldRoleb.ResourceVersion {
-				newEvent.key, err = cache.MetaNamespaceKeyFunc(old)
-				newEvent.eventType = "update"
-				newEvent.resourceType = resourceType
-				newEvent.newObj = newRoleb
-				newEvent.oldObj = oldRoleb
-				logrus.WithField("resource", resourceType).Infof("Processing update to %v: %s", resourceType, newEvent.key)
-				if err == nil {
-					queue.Add(newEvent)
+			// periodic resyncs deliver unchanged objects, the handler checks them for drift
+			if GetObjectMetaData(new).GetResourceVersion() == GetObjectMetaData(old).GetResourceVersion() {
+				key, err := cache.MetaNamespaceKeyFunc(new)
+				if err != nil {
+					return
 				}
+				logger.Debugf("Resync of %s", key)
+				c.enqueueResync(key)
+				return
 			}
-
+			enqueue(new, "update")
 		},
 		DeleteFunc: func(obj interface{}) {
-			newEvent.key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			newEvent.eventType = "delete"
-			newEvent.resourceType = resourceType
-			newEvent.namespace = GetObjectMetaData(obj).Namespace
-			logrus.WithField("resource", resourceType).Infof("Processing delete to %v: %s", resourceType, newEvent.key)
-			if err == nil {
-				queue.Add(newEvent)
-			}
+			enqueue(obj, "delete")
 		},
 	})
+	return c
+}
 
-	return &Controller{
-		logger:       logrus.WithField("resource", resourceType),
-		clientset:    client,
-		informer:     informer,
-		queue:        queue,
-		eventHandler: eventHandler,
+// enqueue adds a key to the queue, a pending resync is kept until the key is processed
+func (c *Controller) enqueue(key string, resync bool) {
+	c.mu.Lock()
+	if resync {
+		c.resync[key] = true
 	}
+	resync = c.resync[key]
+	c.mu.Unlock()
+	c.queue.add(key, resync)
+}
+
+// enqueueResync adds the key of a periodic resync to the queue. The key is not stored on the etcd cluster,
+// the object did not change and is listed again on the next start.
+func (c *Controller) enqueueResync(key string) {
+	c.mu.Lock()
+	c.resync[key] = true
+	c.mu.Unlock()
+	c.queue.addUnstored(key)
 }
 
-// Run starts the controller controller
-func (c *Controller) Run(stopCh <-chan struct{}, resourceType string) {
+// replay queues the keys that were pending when the controller stopped
+func (c *Controller) replay(ctx context.Context) {
+	items, err := c.queue.pending(ctx)
+	if err != nil {
+		c.logger.Errorf("Unable to load pending keys from etcd cluster: %v", err)
+		return
+	}
+	if len(items) > 0 {
+		c.logger.Infof("Replaying %d pending keys", len(items))
+	}
+	for _, item := range items {
+		c.enqueue(item.Key, item.Resync)
+	}
+	if dead, err := c.queue.deadLetters(ctx); err == nil && len(dead) > 0 {
+		c.logger.Warnf("%d keys exhausted their retries and are kept as dead letters", len(dead))
+	}
+}
+
+// Run starts the controller, the informer is run by the registry. The keys are processed with workCtx.
+// Once ctx is cancelled the workers stop taking keys off the queue, Run returns when the keys in process are done.
+func (c *Controller) Run(ctx context.Context, workCtx context.Context) {
 	defer utilruntime.HandleCrash()
 	defer c.queue.ShutDown()
 
-	c.logger.Infof("Starting %s controller", resourceType)
-	serverStartTime = time.Now().Local()
+	c.logger.Info("Starting controller")
 
-	go c.informer.Run(stopCh)
-
-	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), c.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
 
-	c.logger.Infof("%s controller synced and ready", resourceType)
+	if h, ok := c.eventHandler.(SyncHandler); ok {
+		h.CacheSynced(workCtx)
+	}
+	go c.queue.storeKeys(workCtx)
+
+	workers := c.workers
+	if workers < 1 {
+		workers = 1
+	}
+	c.logger.Infof("Controller synced and ready, starting %d workers", workers)
+
+	// the queue never hands out a key to two workers at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { c.runWorker(ctx, workCtx) }, time.Second, ctx.Done())
+		}()
+	}
+	<-ctx.Done()
+	c.logger.Info("Stopping workers")
+	c.queue.ShutDown()
+	wg.Wait()
+	// keys added last are stored, so they are replayed on the next start
+	c.queue.storeAdded(workCtx)
+}
 
-	wait.Until(c.runWorker, time.Second, stopCh)
+// enqueueNamespace adds every cached object of a namespace to the queue.
+// With resync the objects are passed to the handler even if they did not change, e.g. because the namespace metadata changed.
+func (c *Controller) enqueueNamespace(namespace string, resync bool) {
+	objs, err := c.informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		c.logger.Errorf("Unable to list objects in namespace %s: %v", namespace, err)
+		return
+	}
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		c.logger.Infof("Processing namespace change of %s", key)
+		c.enqueue(key, resync)
+	}
 }
 
-func (c *Controller) runWorker() {
+func (c *Controller) runWorker(ctx context.Context, workCtx context.Context) {
 	// processNextWorkItem will automatically wait until there's work available
-	for c.processNextItem() {
+	for c.waitUnpaused(ctx.Done()) && c.processNextItem(ctx, workCtx) {
 		// continue looping
 	}
 }
 
+// waitUnpaused blocks while the handler is paused, the keys stay queued meanwhile.
+// It returns false when the controller is stopped.
+func (c *Controller) waitUnpaused(stopCh <-chan struct{}) bool {
+	h, ok := c.eventHandler.(PausingHandler)
+	if !ok {
+		return true
+	}
+	for {
+		d := h.Paused()
+		if d <= 0 {
+			return true
+		}
+		c.logger.Warnf("Handler paused, resuming in %s", d)
+		select {
+		case <-time.After(d):
+		case <-stopCh:
+			return false
+		}
+	}
+}
+
 // HasSynced is required for the cache.Controller interface.
 func (c *Controller) HasSynced() bool {
 	return c.informer.HasSynced()
@@ -331,57 +346,132 @@ func (c *Controller) LastSyncResourceVersion() string {
 
 // processNextWorkItem deals with one key off the queue.  It returns false
 // when it's time to quit.
-func (c *Controller) processNextItem() bool {
-	newEvent, quit := c.queue.Get()
+func (c *Controller) processNextItem(ctx context.Context, workCtx context.Context) bool {
+	key, quit := c.queue.Get()
 
 	if quit {
 		return false
 	}
-	defer c.queue.Done(newEvent)
-	err := c.processItem(newEvent.(Event))
+	// keys left in the queue on shutdown stay stored and are replayed on the next start
+	if ctx.Err() != nil {
+		c.queue.Done(key)
+		return false
+	}
+	generation := c.queue.generationOf(key.(string))
+	if err := c.processItem(workCtx, key.(string), generation); err != errDeferred {
+		c.finish(workCtx, key.(string), generation, err)
+	}
+	return true
+}
+
+// finish forgets a processed key or schedules its retry, keys that exhausted their retries are moved to the dead letters.
+// Keys failing on shutdown stay stored and are replayed on the next start.
+// The key stays in process until it is finished, so a deferred key is not handed out again before its batch is flushed.
+func (c *Controller) finish(workCtx context.Context, key string, generation int, err error) {
+	defer c.queue.Done(key)
 	if err == nil {
 		// No error, reset the ratelimit counters
-		c.queue.Forget(newEvent)
-	} else if c.queue.NumRequeues(newEvent) < maxRetries {
-		c.logger.Errorf("Error processing %s (will retry): %v", newEvent.(Event).key, err)
-		c.queue.AddRateLimited(newEvent)
+		c.queue.Forget(key)
+		c.queue.succeeded(workCtx, key, generation)
+	} else if workCtx.Err() != nil || c.queue.ShuttingDown() {
+		c.logger.Warnf("Processing of %s aborted on shutdown, it is replayed on the next start: %v", key, err)
+	} else if isTemporary(err) {
+		delay := retryDelay(err)
+		c.logger.Warnf("Error processing %s (will retry in %s): %v", key, delay, err)
+		c.queue.Forget(key)
+		c.queue.AddAfter(key, delay)
+	} else if c.queue.NumRequeues(key) < maxRetries {
+		c.logger.Errorf("Error processing %s (will retry): %v", key, err)
+		c.queue.AddRateLimited(key)
 	} else {
 		// err != nil and too many retries
-		c.logger.Errorf("Error processing %s (giving up): %v", newEvent.(Event).key, err)
-		c.queue.Forget(newEvent)
+		c.logger.Errorf("Error processing %s (giving up): %v", key, err)
+		c.mu.Lock()
+		resync := c.resync[key]
+		delete(c.resync, key)
+		c.mu.Unlock()
+		c.queue.deadLetter(workCtx, key, generation, c.queue.NumRequeues(key)+1, resync, err)
+		c.queue.Forget(key)
 		utilruntime.HandleError(err)
 	}
-	return true
 }
 
-func (c *Controller) processItem(newEvent Event) error {
-	obj, _, err := c.informer.GetIndexer().GetByKey(newEvent.key)
-	if err != nil {
-		return fmt.Errorf("Error fetching object with key %s from store: %v", newEvent.key, err)
-	}
-	// get object's metedata
-	objectMeta := GetObjectMetaData(obj)
-
-	// process events based on its type
-	switch newEvent.eventType {
-	case "create":
-		// compare CreationTimestamp and serverStartTime and alert only on latest events
-		// Could be Replaced by using Delta or DeltaFIFO
-		if objectMeta.CreationTimestamp.Sub(serverStartTime).Seconds() > 0 {
-			c.eventHandler.ObjectCreated(obj)
-		}
-	case "update":
-		c.eventHandler.ObjectUpdated(newEvent)
+// completionKey is the context key of the completion of a deferred event
+type completionKey struct{}
+
+// completionOf returns the completion of the event processed with the context, nil if the event cannot be deferred
+func completionOf(ctx context.Context) completion {
+	done, _ := ctx.Value(completionKey{}).(completion)
+	return done
+}
+
+// lastState returns the object as last passed to the handler, nil if the handler does not know it
+func (c *Controller) lastState(ctx context.Context, key string) (interface{}, error) {
+	if h, ok := c.eventHandler.(StatefulHandler); ok {
+		return h.LastState(ctx, c.resource, key)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state[key], nil
+}
 
-	case "delete":
-		//rb := Rolebinding{
-		//	Name:      newEvent.key,
-		//	Namespace: newEvent.namespace,
-		//	Action:    "delete",
-		//}
-		//c.eventHandler.ObjectDeleted(obj)
-		c.eventHandler.ObjectDeleted(newEvent.key)
+// processItem compares the current state of an object with the state last passed to the handler
+// and calls the handler accordingly. Objects of namespaces or roleRefs that are not selected are handled like deleted objects.
+func (c *Controller) processItem(ctx context.Context, key string, generation int) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return fmt.Errorf("Error fetching object with key %s from store: %v", key, err)
+	}
+	if exists && (!c.nsFilter.selectedByName(GetObjectMetaData(obj).GetNamespace()) || !c.rbFilter.selected(obj)) {
+		exists = false
+	}
+	previous, err := c.lastState(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Error fetching last state of %s: %v", key, err)
 	}
-	return nil
 
+	c.mu.Lock()
+	resync := c.resync[key]
+	delete(c.resync, key)
+	c.mu.Unlock()
+
+	complete := func(err error) error {
+		if err != nil {
+			// the resync is kept for the retry, the stored state has not changed
+			if resync {
+				c.mu.Lock()
+				c.resync[key] = true
+				c.mu.Unlock()
+			}
+			return err
+		}
+		if _, ok := c.eventHandler.(StatefulHandler); !ok {
+			c.mu.Lock()
+			if exists {
+				c.state[key] = obj
+			} else {
+				delete(c.state, key)
+			}
+			c.mu.Unlock()
+		}
+		return nil
+	}
+	// a deferred event is finished by the handler once it is done
+	workCtx := ctx
+	ctx = context.WithValue(workCtx, completionKey{}, completion(func(err error) {
+		c.finish(workCtx, key, generation, complete(err))
+	}))
+
+	switch {
+	case exists && previous == nil:
+		err = c.eventHandler.ObjectCreated(ctx, obj)
+	case exists && (resync || GetObjectMetaData(previous).GetResourceVersion() != GetObjectMetaData(obj).GetResourceVersion()):
+		err = c.eventHandler.ObjectUpdated(ctx, previous, obj)
+	case !exists && previous != nil:
+		err = c.eventHandler.ObjectDeleted(ctx, previous)
+	}
+	if err == errDeferred {
+		return err
+	}
+	return complete(err)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// deferredEvent is an event passed to the deferringHandler
+type deferredEvent struct {
+	old, new interface{}
+	done     completion
+}
+
+// deferringHandler defers every event until the test completes it
+type deferringHandler struct {
+	events chan deferredEvent
+}
+
+func (h *deferringHandler) Init(c Config) error { return nil }
+
+func (h *deferringHandler) ObjectCreated(ctx context.Context, obj interface{}) error {
+	h.events <- deferredEvent{new: obj, done: completionOf(ctx)}
+	return errDeferred
+}
+
+func (h *deferringHandler) ObjectUpdated(ctx context.Context, oldObj, newObj interface{}) error {
+	h.events <- deferredEvent{old: oldObj, new: newObj, done: completionOf(ctx)}
+	return errDeferred
+}
+
+func (h *deferringHandler) ObjectDeleted(ctx context.Context, obj interface{}) error {
+	h.events <- deferredEvent{old: obj, done: completionOf(ctx)}
+	return errDeferred
+}
+
+func testBinding(version string) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "rb", ResourceVersion: version}}
+}
+
+func TestDeferredKeyStaysInProcess(t *testing.T) {
+	kv := useFakeKV()
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &rbacv1.RoleBinding{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	h := &deferringHandler{events: make(chan deferredEvent, 2)}
+	c := newResourceController(nil, h, informer, "rolebindings", &namespaceFilter{}, &bindingFilter{})
+	defer c.queue.ShutDown()
+	ctx := context.Background()
+
+	informer.GetIndexer().Add(testBinding("1"))
+	c.enqueue("ns/rb", false)
+	if !c.processNextItem(ctx, ctx) {
+		t.Fatal("queue shut down")
+	}
+	first := <-h.events
+	if first.old != nil || GetObjectMetaData(first.new).GetResourceVersion() != "1" {
+		t.Fatalf("got %v -> %v, want creation of version 1", first.old, first.new)
+	}
+
+	// the binding changes while its first event waits for its batch
+	informer.GetIndexer().Update(testBinding("2"))
+	c.enqueue("ns/rb", false)
+	processed := make(chan bool)
+	go func() {
+		processed <- c.processNextItem(ctx, ctx)
+	}()
+	select {
+	case e := <-h.events:
+		t.Fatalf("key handed out again before its first event was finished: %v -> %v", e.old, e.new)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.done(nil)
+	var second deferredEvent
+	select {
+	case second = <-h.events:
+	case <-time.After(time.Second):
+		t.Fatal("key not processed again after its first event was finished")
+	}
+	<-processed
+	if GetObjectMetaData(second.old).GetResourceVersion() != "1" || GetObjectMetaData(second.new).GetResourceVersion() != "2" {
+		t.Errorf("got update %v -> %v, want version 1 -> 2", second.old, second.new)
+	}
+	second.done(nil)
+
+	if state := c.state["ns/rb"]; GetObjectMetaData(state).GetResourceVersion() != "2" {
+		t.Errorf("last state is %v, want version 2", state)
+	}
+	if c.queue.Len() != 0 {
+		t.Errorf("%d keys left in the queue", c.queue.Len())
+	}
+	if keys := kv.keys(queueKeyPrefix); len(keys) != 0 {
+		t.Errorf("pending keys left on the etcd cluster: %v", keys)
+	}
+}
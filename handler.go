@@ -1,6 +1,10 @@
 package main
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
 
 // Default handler implements Handler interface,
 // print each event with JSON format
@@ -14,17 +18,19 @@ func (d *Default) Init(c Config) error {
 }
 
 // ObjectCreated sends events on object creation
-func (d *Default) ObjectCreated(obj interface{}) {
+func (d *Default) ObjectCreated(ctx context.Context, obj interface{}) error {
 	logrus.Info("Default CREATE function invoked")
+	return nil
 }
 
 // ObjectDeleted sends events on object deletion
-func (d *Default) ObjectDeleted(obj interface{}) {
+func (d *Default) ObjectDeleted(ctx context.Context, obj interface{}) error {
 	logrus.Info("Default DELETE function invoked")
+	return nil
 }
 
 // ObjectUpdated sends events on object updation
-func (d *Default) ObjectUpdated(obj interface{}) {
+func (d *Default) ObjectUpdated(ctx context.Context, oldObj, newObj interface{}) error {
 	logrus.Info("Default UPDATE function invoked")
-
+	return nil
 }
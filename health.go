@@ -2,18 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/sirupsen/logrus"
 )
 
-func getHealth() {
+// newHealthServer returns the server of the health checks, the metrics and the admin API
+func newHealthServer() *http.Server {
 	router := mux.NewRouter()
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 	}).Methods("GET")
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	adminRoutes(router)
 
 	srv := &http.Server{
 		Handler:      router,
@@ -22,5 +25,5 @@ func getHealth() {
 		ReadTimeout:  15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
-	logrus.Fatal(srv.ListenAndServe())
+	return srv
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// groups are synced from LDAP, the console group name is the CN of the group DN
+	identityLDAP = "ldap"
+	// the console authenticates through SAML, groups are identified by the IdP (e.g. Azure AD object IDs)
+	identitySAML = "saml"
+	// the console authenticates through OpenID Connect, groups are identified by a claim value
+	identityOIDC = "oidc"
+)
+
+var groupCN = regexp.MustCompile(`^CN=(?P<groupcn>[^,]*)`)
+
+// groupNameData is passed to the group name template
+type groupNameData struct {
+	// Name of the OpenShift group
+	Name string
+	// CN of the group if its name is a DN
+	CN string
+}
+
+// identityMapper translates OpenShift groups to the group identifiers of the console's identity provider
+type identityMapper struct {
+	mode    string
+	mapping map[string]string
+	tmpl    *template.Template
+}
+
+func newIdentityMapper(c IdentityConfig) (*identityMapper, error) {
+	m := &identityMapper{mode: c.Mode, mapping: c.GroupMapping}
+	switch c.Mode {
+	case "":
+		m.mode = identityLDAP
+	case identityLDAP, identitySAML, identityOIDC:
+	default:
+		return nil, fmt.Errorf("Unknown identity mode %q", c.Mode)
+	}
+	if len(c.GroupTemplate) > 0 {
+		tmpl, err := template.New("group-name").Funcs(templateFuncs).Option("missingkey=error").Parse(c.GroupTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid group template %q: %v", c.GroupTemplate, err)
+		}
+		m.tmpl = tmpl
+	}
+	return m, nil
+}
+
+// groupName returns the console group name of an OpenShift group,
+// an empty name means the group is not synced
+func (m *identityMapper) groupName(group string) string {
+	if id, ok := m.mapping[group]; ok {
+		return id
+	}
+
+	data := groupNameData{Name: group}
+	if matches := groupCN.FindStringSubmatch(group); len(matches) > 1 {
+		data.CN = matches[1]
+	}
+	if m.tmpl != nil {
+		var buf bytes.Buffer
+		if err := m.tmpl.Execute(&buf, data); err != nil {
+			logrus.Warnf("Unable to render group name for %s: %v", group, err)
+			return ""
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	if m.mode == identityLDAP {
+		return data.CN
+	}
+	return group
+}
+
+// flags sets the identity provider flags of a group
+func (m *identityMapper) flags(twgroup *TwistlockGroup) {
+	twgroup.LdapGroup = m.mode == identityLDAP
+	twgroup.SamlGroup = m.mode == identitySAML
+	twgroup.OidcGroup = m.mode == identityOIDC
+}
@@ -33,8 +33,8 @@ func getEtcdClient() (*clientv3.Client, error) {
 	return cli, nil
 }
 
-func kvPut(k, v string) (*clientv3.PutResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func kvPut(ctx context.Context, k, v string) (*clientv3.PutResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	putResp, err := etcdClient.Put(ctx, k, v)
 	cancel()
 	if err != nil {
@@ -44,8 +44,8 @@ func kvPut(k, v string) (*clientv3.PutResponse, error) {
 
 }
 
-func kvGet(k string) (*clientv3.GetResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func kvGet(ctx context.Context, k string) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	getResp, err := etcdClient.Get(ctx, k)
 	cancel()
 	if err != nil {
@@ -55,8 +55,8 @@ func kvGet(k string) (*clientv3.GetResponse, error) {
 
 }
 
-func kvDel(k string) (*clientv3.DeleteResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func kvDel(ctx context.Context, k string) (*clientv3.DeleteResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	delResp, err := etcdClient.Delete(ctx, k)
 	cancel()
 	if err != nil {
@@ -65,3 +65,27 @@ func kvDel(k string) (*clientv3.DeleteResponse, error) {
 	return delResp, nil
 
 }
+
+func kvList(ctx context.Context, prefix string) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	getResp, err := etcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	return getResp, nil
+}
+
+// kvDelIf deletes a key only if it was last modified at the given revision, it reports whether the key was deleted
+func kvDelIf(ctx context.Context, k string, rev int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	txnResp, err := etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(k), "=", rev)).
+		Then(clientv3.OpDelete(k)).
+		Commit()
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// fakeKV is an in-memory etcd key value store, it supports the calls of kvstore.go
+type fakeKV struct {
+	mu   sync.Mutex
+	rev  int64
+	data map[string]*mvccpb.KeyValue
+	// called once before the next put, delete or transaction, to interleave other calls
+	before func()
+}
+
+// useFakeKV replaces the etcd client with an empty in-memory store
+func useFakeKV() *fakeKV {
+	kv := &fakeKV{data: map[string]*mvccpb.KeyValue{}}
+	etcdClient = &clientv3.Client{KV: kv}
+	return kv
+}
+
+// keys returns the stored keys with a prefix
+func (kv *fakeKV) keys(prefix string) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	var keys []string
+	for k := range kv.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// interleave runs and clears the before hook
+func (kv *fakeKV) interleave() {
+	kv.mu.Lock()
+	before := kv.before
+	kv.before = nil
+	kv.mu.Unlock()
+	if before != nil {
+		before()
+	}
+}
+
+func (kv *fakeKV) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: kv.rev}
+}
+
+func (kv *fakeKV) put(key, val string) *clientv3.PutResponse {
+	kv.rev++
+	kv.data[key] = &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val), ModRevision: kv.rev}
+	return &clientv3.PutResponse{Header: kv.header()}
+}
+
+func (kv *fakeKV) get(op clientv3.Op) *clientv3.GetResponse {
+	key := string(op.KeyBytes())
+	resp := &clientv3.GetResponse{Header: kv.header()}
+	for k, v := range kv.data {
+		// only exact keys and prefixes are supported
+		if k == key || len(op.RangeBytes()) > 0 && strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, v)
+		}
+	}
+	resp.Count = int64(len(resp.Kvs))
+	return resp
+}
+
+func (kv *fakeKV) del(key string) *clientv3.DeleteResponse {
+	resp := &clientv3.DeleteResponse{}
+	if _, ok := kv.data[key]; ok {
+		kv.rev++
+		delete(kv.data, key)
+		resp.Deleted = 1
+	}
+	resp.Header = kv.header()
+	return resp
+}
+
+func (kv *fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	kv.interleave()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.put(key, val), nil
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.get(clientv3.OpGet(key, opts...)), nil
+}
+
+func (kv *fakeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	kv.interleave()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.del(key), nil
+}
+
+func (kv *fakeKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return &clientv3.CompactResponse{}, nil
+}
+
+func (kv *fakeKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.do(op), nil
+}
+
+func (kv *fakeKV) do(op clientv3.Op) clientv3.OpResponse {
+	switch {
+	case op.IsPut():
+		return kv.put(string(op.KeyBytes()), string(op.ValueBytes())).OpResponse()
+	case op.IsGet():
+		return kv.get(op).OpResponse()
+	case op.IsDelete():
+		return kv.del(string(op.KeyBytes())).OpResponse()
+	}
+	return clientv3.OpResponse{}
+}
+
+func (kv *fakeKV) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{kv: kv}
+}
+
+// fakeTxn is a transaction of the fake store, only ModRevision comparisons are supported
+type fakeTxn struct {
+	kv         *fakeKV
+	cmps       []clientv3.Cmp
+	then, elze []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elze = append(t.elze, ops...)
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.kv.interleave()
+	t.kv.mu.Lock()
+	defer t.kv.mu.Unlock()
+	succeeded := true
+	for _, cmp := range t.cmps {
+		var rev int64
+		if v, ok := t.kv.data[string(cmp.Key)]; ok {
+			rev = v.ModRevision
+		}
+		want, _ := cmp.TargetUnion.(*pb.Compare_ModRevision)
+		if cmp.Target != pb.Compare_MOD || cmp.Result != pb.Compare_EQUAL || want == nil || rev != want.ModRevision {
+			succeeded = false
+		}
+	}
+	ops := t.then
+	if !succeeded {
+		ops = t.elze
+	}
+	for _, op := range ops {
+		t.kv.do(op)
+	}
+	return &clientv3.TxnResponse{Header: t.kv.header(), Succeeded: succeeded}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedMutex serializes the work on the same Twistlock objects, work on different objects runs in parallel
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// lock acquires the locks of all keys and returns a function releasing them.
+// The keys are locked in sorted order, so two callers sharing several keys cannot deadlock.
+func (k *keyedMutex) lock(keys ...string) func() {
+	var sorted []string
+	for _, key := range keys {
+		if !sliceContains(sorted, key) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	var held []*keyedLock
+	for _, key := range sorted {
+		k.mu.Lock()
+		l, ok := k.locks[key]
+		if !ok {
+			l = &keyedLock{}
+			k.locks[key] = l
+		}
+		l.refs++
+		k.mu.Unlock()
+
+		l.Lock()
+		held = append(held, l)
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+			k.mu.Lock()
+			held[i].refs--
+			if held[i].refs == 0 {
+				delete(k.locks, sorted[i])
+			}
+			k.mu.Unlock()
+		}
+	}
+}
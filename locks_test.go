@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexLock(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  []string
+		second []string
+		// whether the second caller has to wait for the first one
+		blocks bool
+	}{
+		{name: "same key", first: []string{"a"}, second: []string{"a"}, blocks: true},
+		{name: "different keys", first: []string{"a"}, second: []string{"b"}, blocks: false},
+		{name: "shared key", first: []string{"a", "b"}, second: []string{"c", "b"}, blocks: true},
+		{name: "duplicated keys", first: []string{"a", "a"}, second: []string{"b", "b"}, blocks: false},
+		{name: "no keys", first: nil, second: []string{"a"}, blocks: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newKeyedMutex()
+			unlock := k.lock(tt.first...)
+
+			locked := make(chan struct{})
+			go func() {
+				k.lock(tt.second...)()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+				if tt.blocks {
+					t.Fatal("second caller did not wait for the first one")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if !tt.blocks {
+					t.Fatal("second caller waits for the first one")
+				}
+			}
+
+			unlock()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				t.Fatal("second caller still waits after the first one released its keys")
+			}
+			if len(k.locks) != 0 {
+				t.Errorf("%d locks left after all keys were released", len(k.locks))
+			}
+		})
+	}
+}
+
+func TestKeyedMutexNoDeadlock(t *testing.T) {
+	k := newKeyedMutex()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			k.lock("a", "b", "c")()
+		}()
+		go func() {
+			defer wg.Done()
+			k.lock("c", "b", "a")()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callers locking the same keys in different order deadlocked")
+	}
+}
@@ -1,18 +1,44 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
+// healthShutdownTimeout is how long open health and admin requests are waited for on shutdown
+const healthShutdownTimeout = 5 * time.Second
+
 func main() {
-	go getHealth()
+	// the root context is cancelled on SIGTERM, a second signal exits right away
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %s, shutting down", sig)
+		cancel()
+		sig = <-signals
+		logrus.Fatalf("Received %s during shutdown, exiting", sig)
+	}()
+
+	health := newHealthServer()
+	go func() {
+		if err := health.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
 
 	var err error
 	etcdClient, err = getEtcdClient()
 	if err != nil {
 		logrus.Panicf("Unable to establish connection to etcd. Error: %s", err)
 	}
-	defer etcdClient.Close()
 	twc, err := getTwistlockConfig()
 	if err != nil {
 		logrus.Panic(err)
@@ -20,5 +46,19 @@ func main() {
 	logrus.Println("TWCONFIG: ", twc)
 	config := initConfig()
 	logrus.Printf("%+v\n ", config)
-	startController(config)
+	err = startController(ctx, config)
+
+	// the health server and the etcd client are closed once no worker uses them anymore
+	healthCtx, cancelHealth := context.WithTimeout(context.Background(), healthShutdownTimeout)
+	if herr := health.Shutdown(healthCtx); herr != nil {
+		logrus.Warnf("Unable to shut down health server: %v", herr)
+	}
+	cancelHealth()
+	etcdClient.Close()
+
+	if err != nil {
+		logrus.Errorf("Controller stopped before its work was done: %v", err)
+		os.Exit(1)
+	}
+	logrus.Info("Controller stopped")
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+const (
+	defaultDisplayNameAnnotation = "openshift.io/display-name"
+	defaultRequesterAnnotation   = "openshift.io/requester"
+)
+
+// collectionMetadata derives the description and color of a collection from the metadata of its projects
+type collectionMetadata struct {
+	displayName string
+	requester   string
+	teamLabel   string
+}
+
+func newCollectionMetadata(c MetadataConfig) *collectionMetadata {
+	m := &collectionMetadata{
+		displayName: c.DisplayNameAnnotation,
+		requester:   c.RequesterAnnotation,
+		teamLabel:   c.TeamLabel,
+	}
+	if len(m.displayName) == 0 {
+		m.displayName = defaultDisplayNameAnnotation
+	}
+	if len(m.requester) == 0 {
+		m.requester = defaultRequesterAnnotation
+	}
+	return m
+}
+
+// apply fills the display names, requesters, team, color and description of a collection
+func (m *collectionMetadata) apply(twcoll *TwistlockCollection) {
+	var teamValue string
+	for _, ns := range twcoll.Namespaces {
+		meta := twcoll.NamespaceMetadata[ns]
+		displayName := meta.Annotations[m.displayName]
+		if len(displayName) == 0 {
+			displayName = ns
+		}
+		twcoll.DisplayNames = append(twcoll.DisplayNames, displayName)
+		if requester := meta.Annotations[m.requester]; len(requester) > 0 && !sliceContains(twcoll.Requesters, requester) {
+			twcoll.Requesters = append(twcoll.Requesters, requester)
+		}
+		if len(teamValue) == 0 && len(m.teamLabel) > 0 {
+			teamValue = meta.Labels[m.teamLabel]
+		}
+	}
+
+	// the team falls back to the group and then to the collection itself
+	twcoll.Team = teamValue
+	if len(twcoll.Team) == 0 {
+		twcoll.Team = twcoll.CN
+	}
+	if len(twcoll.Team) == 0 {
+		twcoll.Team = twcoll.Name
+	}
+	twcoll.Color = teamColor(twcoll.Team)
+
+	parts := []string{strings.Join(twcoll.DisplayNames, ", ")}
+	if len(twcoll.Requesters) > 0 {
+		parts = append(parts, "requested by "+strings.Join(twcoll.Requesters, ", "))
+	}
+	if len(teamValue) > 0 {
+		parts = append(parts, m.teamLabel+" "+teamValue)
+	}
+	twcoll.Description = strings.Join(parts, " - ")
+}
+
+// teamColor returns a deterministic color for a team name, the hue is derived
+// from the name while saturation and lightness are fixed to keep the colors readable
+func teamColor(team string) string {
+	h := fnv.New32a()
+	h.Write([]byte(team))
+	hue := float64(h.Sum32()%360) / 360
+	r, g, b := hslToRGB(hue, 0.65, 0.45)
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+func hslToRGB(h, s, l float64) (uint8, uint8, uint8) {
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	channel := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		}
+		if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(math.Round(v * 255))
+	}
+	return channel(h + 1.0/3), channel(h), channel(h - 1.0/3)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const defaultSyncAnnotation = "twistlock.io/sync"
+
+// namespaceMatcher is the compiled form of a NamespaceSelector
+type namespaceMatcher struct {
+	selector labels.Selector
+	names    []string
+	patterns []*regexp.Regexp
+}
+
+// namespaceFilter decides which namespaces are synced to Twistlock
+type namespaceFilter struct {
+	include    *namespaceMatcher
+	exclude    *namespaceMatcher
+	annotation string
+	lister     listersv1.NamespaceLister
+}
+
+func newNamespaceMatcher(s NamespaceSelector) (*namespaceMatcher, error) {
+	if len(s.LabelSelector) == 0 && len(s.Names) == 0 && len(s.Patterns) == 0 {
+		return nil, nil
+	}
+	m := &namespaceMatcher{names: s.Names}
+	if len(s.LabelSelector) > 0 {
+		selector, err := labels.Parse(s.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label selector %q: %v", s.LabelSelector, err)
+		}
+		m.selector = selector
+	}
+	for _, name := range s.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("Invalid name pattern %q: %v", name, err)
+		}
+	}
+	for _, pattern := range s.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// matchesName reports whether the name matches one of the glob or regex patterns
+func (m *namespaceMatcher) matchesName(name string) bool {
+	for _, glob := range m.names {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *namespaceMatcher) hasNames() bool {
+	return len(m.names) > 0 || len(m.patterns) > 0
+}
+
+func newNamespaceFilter(s NamespaceSelection) (*namespaceFilter, error) {
+	include, err := newNamespaceMatcher(s.Include)
+	if err != nil {
+		return nil, fmt.Errorf("namespaces.include: %v", err)
+	}
+	exclude, err := newNamespaceMatcher(s.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("namespaces.exclude: %v", err)
+	}
+	return &namespaceFilter{
+		include:    include,
+		exclude:    exclude,
+		annotation: s.SyncAnnotation,
+	}, nil
+}
+
+// selected reports whether a namespace should be synced.
+// The sync annotation overrides the selectors, otherwise a namespace has to
+// match every configured include criteria and none of the exclude criteria.
+func (f *namespaceFilter) selected(ns *apiv1.Namespace) bool {
+	switch ns.Annotations[f.annotation] {
+	case "false":
+		return false
+	case "true":
+		return true
+	}
+
+	if f.include != nil {
+		if f.include.selector != nil && !f.include.selector.Matches(labels.Set(ns.Labels)) {
+			return false
+		}
+		if f.include.hasNames() && !f.include.matchesName(ns.Name) {
+			return false
+		}
+	}
+	if f.exclude != nil {
+		if f.exclude.selector != nil && f.exclude.selector.Matches(labels.Set(ns.Labels)) {
+			return false
+		}
+		if f.exclude.matchesName(ns.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectedByName looks up a namespace in the informer cache and reports whether it should be synced,
+// cluster scoped objects are not filtered
+func (f *namespaceFilter) selectedByName(name string) bool {
+	if f.lister == nil || len(name) == 0 {
+		return true
+	}
+	ns, err := f.lister.Get(name)
+	if err != nil {
+		logrus.Warnf("Unable to get namespace %s from cache: %v", name, err)
+		return false
+	}
+	return f.selected(ns)
+}
+
+func newNamespaceInformer(clientset kubernetes.Interface) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Namespaces().Watch(options)
+			},
+		},
+		&apiv1.Namespace{},
+		0, //Skip resync
+		cache.Indexers{},
+	)
+}
+
+// watchNamespaces requeues the objects of a namespace on the given controller
+// as soon as a label or annotation change adds or removes the namespace from the selection.
+// Objects that arrived before their namespace was cached were skipped, they are requeued once the namespace is added.
+// Label or annotation changes of a selected namespace requeue its objects as well,
+// so the collection metadata derived from them is kept up to date.
+func (f *namespaceFilter) watchNamespaces(informer cache.SharedIndexInformer, c *Controller) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ns := obj.(*apiv1.Namespace)
+			if f.selected(ns) {
+				c.enqueueNamespace(ns.Name, false)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldNs := old.(*apiv1.Namespace)
+			newNs := new.(*apiv1.Namespace)
+			wasSelected := f.selected(oldNs)
+			isSelected := f.selected(newNs)
+			switch {
+			case !wasSelected && isSelected:
+				logrus.Infof("Namespace %s has been selected for sync", newNs.Name)
+				c.enqueueNamespace(newNs.Name, false)
+			case wasSelected && !isSelected:
+				logrus.Infof("Namespace %s has been excluded from sync", newNs.Name)
+				c.enqueueNamespace(newNs.Name, false)
+			case isSelected && metadataChanged(oldNs, newNs):
+				logrus.Infof("Metadata of namespace %s has changed", newNs.Name)
+				c.enqueueNamespace(newNs.Name, true)
+			}
+		},
+	})
+}
+
+// metadataChanged ignores the scan summary annotations written by the controller itself
+func metadataChanged(old, new *apiv1.Namespace) bool {
+	return !reflect.DeepEqual(old.Labels, new.Labels) || !reflect.DeepEqual(syncedAnnotations(old), syncedAnnotations(new))
+}
+
+func syncedAnnotations(ns *apiv1.Namespace) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range ns.Annotations {
+		if !strings.HasPrefix(k, scanAnnotationPrefix) {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceFilterSelected(t *testing.T) {
+	tests := []struct {
+		name        string
+		selection   NamespaceSelection
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		selected    bool
+	}{
+		{name: "no selection", namespace: "team-a", selected: true},
+		{name: "label selector matches", selection: NamespaceSelection{Include: NamespaceSelector{LabelSelector: "team"}}, namespace: "team-a", labels: map[string]string{"team": "a"}, selected: true},
+		{name: "label selector does not match", selection: NamespaceSelection{Include: NamespaceSelector{LabelSelector: "team=b"}}, namespace: "team-a", labels: map[string]string{"team": "a"}, selected: false},
+		{name: "name glob matches", selection: NamespaceSelection{Include: NamespaceSelector{Names: []string{"team-*"}}}, namespace: "team-a", selected: true},
+		{name: "name glob does not match", selection: NamespaceSelection{Include: NamespaceSelector{Names: []string{"team-*"}}}, namespace: "openshift-infra", selected: false},
+		{name: "pattern matches", selection: NamespaceSelection{Include: NamespaceSelector{Patterns: []string{"^team-[a-z]$"}}}, namespace: "team-a", selected: true},
+		{name: "pattern does not match", selection: NamespaceSelection{Include: NamespaceSelector{Patterns: []string{"^team-[a-z]$"}}}, namespace: "team-ab", selected: false},
+		{name: "labels and names both required", selection: NamespaceSelection{Include: NamespaceSelector{LabelSelector: "team", Names: []string{"team-*"}}}, namespace: "team-a", selected: false},
+		{name: "excluded by name", selection: NamespaceSelection{Exclude: NamespaceSelector{Names: []string{"openshift-*"}}}, namespace: "openshift-infra", selected: false},
+		{name: "excluded by label", selection: NamespaceSelection{Exclude: NamespaceSelector{LabelSelector: "system=true"}}, namespace: "kube-system", labels: map[string]string{"system": "true"}, selected: false},
+		{name: "included but excluded", selection: NamespaceSelection{Include: NamespaceSelector{Names: []string{"*"}}, Exclude: NamespaceSelector{Patterns: []string{"^openshift"}}}, namespace: "openshift-infra", selected: false},
+		{name: "annotation overrides exclusion", selection: NamespaceSelection{Exclude: NamespaceSelector{Names: []string{"openshift-*"}}}, namespace: "openshift-infra", annotations: map[string]string{defaultSyncAnnotation: "true"}, selected: true},
+		{name: "annotation overrides inclusion", selection: NamespaceSelection{Include: NamespaceSelector{Names: []string{"team-*"}}}, namespace: "team-a", annotations: map[string]string{defaultSyncAnnotation: "false"}, selected: false},
+		{name: "invalid annotation ignored", selection: NamespaceSelection{Include: NamespaceSelector{Names: []string{"team-*"}}}, namespace: "other", annotations: map[string]string{defaultSyncAnnotation: "yes"}, selected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.selection.SyncAnnotation = defaultSyncAnnotation
+			f, err := newNamespaceFilter(tt.selection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns := &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: tt.namespace, Labels: tt.labels, Annotations: tt.annotations}}
+			if selected := f.selected(ns); selected != tt.selected {
+				t.Errorf("selected(%s) = %v, want %v", tt.namespace, selected, tt.selected)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const defaultNodeSelectorAnnotation = "openshift.io/node-selector"
+
+func newNodeInformer(clientset kubernetes.Interface) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Nodes().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Nodes().Watch(options)
+			},
+		},
+		&apiv1.Node{},
+		0, //Skip resync
+		cache.Indexers{},
+	)
+}
+
+// parseNodeSelector returns the node selector of a project,
+// projects without a selector may run on every node
+func parseNodeSelector(annotations map[string]string, annotation string) (labels.Selector, bool) {
+	value := annotations[annotation]
+	if len(value) == 0 {
+		return nil, false
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		logrus.Warnf("Invalid node selector %q: %v", value, err)
+		return nil, false
+	}
+	return selector, true
+}
+
+// selectedNodes returns the names of the cached nodes matching a selector
+func selectedNodes(selector labels.Selector) []string {
+	var names []string
+	if clusterCache == nil || clusterCache.nodes == nil {
+		return names
+	}
+	nodes, err := clusterCache.nodes.List(selector)
+	if err != nil {
+		logrus.Warnf("Unable to list nodes from cache: %v", err)
+		return names
+	}
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+// watchNodes requeues the objects of every selected namespace pinned to a node
+// when the node is added, removed or relabeled, so the hosts of its collection are kept up to date.
+// The informer has synced already, the adds of the cached nodes are ignored.
+func (f *namespaceFilter) watchNodes(informer cache.SharedIndexInformer, annotation string, c *Controller) {
+	// resource versions of the cached nodes, the handler receives them as adds once it is added.
+	// The callbacks of a handler are called one at a time.
+	cached := map[string]string{}
+	for _, obj := range informer.GetStore().List() {
+		node := obj.(*apiv1.Node)
+		cached[node.Name] = node.ResourceVersion
+	}
+	requeue := func(nodes ...*apiv1.Node) {
+		namespaces, err := f.lister.List(labels.Everything())
+		if err != nil {
+			logrus.Warnf("Unable to list namespaces from cache: %v", err)
+			return
+		}
+		for _, ns := range namespaces {
+			selector, ok := parseNodeSelector(ns.Annotations, annotation)
+			if !ok || !f.selected(ns) {
+				continue
+			}
+			for _, node := range nodes {
+				if selector.Matches(labels.Set(node.Labels)) {
+					c.enqueueNamespace(ns.Name, true)
+					break
+				}
+			}
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			node := obj.(*apiv1.Node)
+			version, ok := cached[node.Name]
+			delete(cached, node.Name)
+			if ok && version == node.ResourceVersion {
+				return
+			}
+			logrus.Infof("Node %s has been added", node.Name)
+			requeue(node)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldNode := old.(*apiv1.Node)
+			newNode := new.(*apiv1.Node)
+			if reflect.DeepEqual(oldNode.Labels, newNode.Labels) {
+				return
+			}
+			logrus.Infof("Labels of node %s have changed", newNode.Name)
+			requeue(oldNode, newNode)
+		},
+		DeleteFunc: func(obj interface{}) {
+			node, ok := obj.(*apiv1.Node)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				if node, ok = tombstone.Obj.(*apiv1.Node); !ok {
+					return
+				}
+			}
+			logrus.Infof("Node %s has been removed", node.Name)
+			requeue(node)
+		},
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+const (
+	// add and remove the touched namespaces, keep other owned fields that were edited in the console
+	conflictMerge = "merge"
+	// set all owned fields to the desired state, manual edits are overwritten
+	conflictOverride = "override"
+	// leave a collection untouched as soon as one of its owned fields was edited in the console
+	conflictSkip = "skip"
+)
+
+// etcd key prefix of the owned fields last written to a collection
+const appliedKeyPrefix = "_twistlock-controller/applied/collections/"
+
+// fieldOwnership decides which collection fields are written by the controller
+// and how edits made in the console are handled
+type fieldOwnership struct {
+	fields []string
+	policy string
+}
+
+func newFieldOwnership(fields []string, policy string) (*fieldOwnership, error) {
+	o := &fieldOwnership{fields: []string{"namespaces"}, policy: policy}
+	for _, f := range fields {
+		if f == "name" || f == "clusters" {
+			return nil, fmt.Errorf("Collection field %q cannot be owned", f)
+		}
+		if !sliceContains(o.fields, f) {
+			o.fields = append(o.fields, f)
+		}
+	}
+	switch policy {
+	case "":
+		o.policy = conflictMerge
+	case conflictMerge, conflictOverride, conflictSkip:
+	default:
+		return nil, fmt.Errorf("Unknown conflict policy %q", policy)
+	}
+	return o, nil
+}
+
+// owned returns the owned fields of a rendered or received collection
+func (o *fieldOwnership) owned(fields map[string]json.RawMessage) map[string]json.RawMessage {
+	owned := map[string]json.RawMessage{}
+	for _, f := range o.fields {
+		if v, ok := fields[f]; ok {
+			owned[f] = v
+		}
+	}
+	return owned
+}
+
+// manualChanges returns the owned fields whose console value differs from the value last written by the controller.
+// Collections without a record have not been written since field ownership was introduced and count as unchanged.
+func (o *fieldOwnership) manualChanges(current, applied map[string]json.RawMessage) map[string]bool {
+	changed := map[string]bool{}
+	if applied == nil {
+		return changed
+	}
+	for _, f := range o.fields {
+		if !sameField(current[f], applied[f]) {
+			changed[f] = true
+		}
+	}
+	return changed
+}
+
+// appliedRecord returns the owned fields to record after a write. Fields kept because they were edited in the console
+// keep their previously recorded value, so the edit is still detected on the next sync.
+func (o *fieldOwnership) appliedRecord(written, applied map[string]json.RawMessage, kept map[string]bool) map[string]json.RawMessage {
+	record := o.owned(written)
+	for f := range kept {
+		if v, ok := applied[f]; ok {
+			record[f] = v
+		} else {
+			delete(record, f)
+		}
+	}
+	return record
+}
+
+// sameField compares two JSON values, lists of strings are compared regardless of their order
+func sameField(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if len(a) > 0 {
+		if err := json.Unmarshal(a, &va); err != nil {
+			return false
+		}
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &vb); err != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(normalizeField(va), normalizeField(vb))
+}
+
+func normalizeField(v interface{}) interface{} {
+	list, ok := v.([]interface{})
+	if !ok {
+		return v
+	}
+	var strs []string
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return v
+		}
+		strs = append(strs, s)
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// mergeFields returns the JSON object with the given fields replaced, all other fields are kept as received
+func mergeFields(raw map[string]json.RawMessage, fields map[string]json.RawMessage) ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+	for k, v := range raw {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON decodes a collection and keeps all of its fields, including the ones unknown to CollectionAPI
+func (c *CollectionAPI) UnmarshalJSON(data []byte) error {
+	type collection CollectionAPI
+	if err := json.Unmarshal(data, (*collection)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.raw)
+}
+
+// UnmarshalJSON decodes a group and keeps all of its fields, including the ones unknown to GroupAPI
+func (g *GroupAPI) UnmarshalJSON(data []byte) error {
+	type group GroupAPI
+	if err := json.Unmarshal(data, (*group)(g)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &g.raw)
+}
+
+func loadApplied(ctx context.Context, name string) (map[string]json.RawMessage, error) {
+	resp, err := kvGet(ctx, appliedKeyPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var applied map[string]json.RawMessage
+	err = json.Unmarshal(resp.Kvs[0].Value, &applied)
+	return applied, err
+}
+
+func storeApplied(ctx context.Context, name string, fields map[string]json.RawMessage) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	_, err = kvPut(ctx, appliedKeyPrefix+name, string(data))
+	return err
+}
+
+func deleteApplied(ctx context.Context, name string) error {
+	_, err := kvDel(ctx, appliedKeyPrefix+name)
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// rawFields decodes a JSON object into its fields
+func rawFields(t *testing.T, data string) map[string]json.RawMessage {
+	t.Helper()
+	if data == "" {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestSameField(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{name: "both missing", a: "", b: "", same: true},
+		{name: "missing and null", a: "", b: "null", same: true},
+		{name: "missing and set", a: "", b: `"x"`, same: false},
+		{name: "equal strings", a: `"x"`, b: `"x"`, same: true},
+		{name: "different strings", a: `"x"`, b: `"y"`, same: false},
+		{name: "formatting", a: `{"a": 1, "b": [1, 2]}`, b: `{"b":[1,2],"a":1}`, same: true},
+		{name: "string lists in other order", a: `["a","b"]`, b: `["b","a"]`, same: true},
+		{name: "string lists of different length", a: `["a","b"]`, b: `["a"]`, same: false},
+		{name: "number lists in other order", a: `[1,2]`, b: `[2,1]`, same: false},
+		{name: "invalid", a: `{`, b: `{`, same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := sameField(json.RawMessage(tt.a), json.RawMessage(tt.b)); same != tt.same {
+				t.Errorf("sameField(%s, %s) = %v, want %v", tt.a, tt.b, same, tt.same)
+			}
+		})
+	}
+}
+
+func TestManualChanges(t *testing.T) {
+	o, err := newFieldOwnership([]string{"description", "color"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		current string
+		applied string
+		changed []string
+	}{
+		{name: "no record", current: `{"namespaces":["a"],"color":"#fff"}`, applied: "", changed: nil},
+		{name: "unchanged", current: `{"namespaces":["b","a"],"color":"#fff"}`, applied: `{"namespaces":["a","b"],"color":"#fff"}`, changed: nil},
+		{name: "namespace added", current: `{"namespaces":["a","c"],"color":"#fff"}`, applied: `{"namespaces":["a"],"color":"#fff"}`, changed: []string{"namespaces"}},
+		{name: "field edited", current: `{"namespaces":["a"],"color":"#000"}`, applied: `{"namespaces":["a"],"color":"#fff"}`, changed: []string{"color"}},
+		{name: "field set", current: `{"namespaces":["a"],"description":"x"}`, applied: `{"namespaces":["a"]}`, changed: []string{"description"}},
+		{name: "unowned field edited", current: `{"namespaces":["a"],"owner":"x"}`, applied: `{"namespaces":["a"]}`, changed: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := o.manualChanges(rawFields(t, tt.current), rawFields(t, tt.applied))
+			want := map[string]bool{}
+			for _, f := range tt.changed {
+				want[f] = true
+			}
+			if !reflect.DeepEqual(changed, want) {
+				t.Errorf("got %v, want %v", changed, want)
+			}
+		})
+	}
+}
+
+func TestMergeFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		fields string
+		want   string
+	}{
+		{name: "unknown fields kept", raw: `{"name":"c","owner":"x","namespaces":["a"]}`, fields: `{"namespaces":["a","b"]}`, want: `{"name":"c","owner":"x","namespaces":["a","b"]}`},
+		{name: "field added", raw: `{"name":"c"}`, fields: `{"color":"#fff"}`, want: `{"name":"c","color":"#fff"}`},
+		{name: "no fields", raw: `{"name":"c"}`, fields: `{}`, want: `{"name":"c"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := rawFields(t, tt.raw)
+			data, err := mergeFields(raw, rawFields(t, tt.fields))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rawFields(t, string(data)), rawFields(t, tt.want)) {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+			if !reflect.DeepEqual(raw, rawFields(t, tt.raw)) {
+				t.Error("the received fields have been modified")
+			}
+		})
+	}
+}
+
+func TestAppliedRecord(t *testing.T) {
+	o, err := newFieldOwnership([]string{"description", "color"}, conflictMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		written string
+		applied string
+		kept    []string
+		want    string
+	}{
+		{name: "nothing kept", written: `{"name":"c","namespaces":["a"],"color":"#000"}`, applied: `{"namespaces":[],"color":"#fff"}`, want: `{"namespaces":["a"],"color":"#000"}`},
+		{name: "kept field recorded as applied before", written: `{"namespaces":["a"],"color":"#000"}`, applied: `{"namespaces":[],"color":"#fff"}`, kept: []string{"color"}, want: `{"namespaces":["a"],"color":"#fff"}`},
+		{name: "kept field never applied", written: `{"namespaces":["a"],"description":"manual"}`, applied: `{"namespaces":[]}`, kept: []string{"description"}, want: `{"namespaces":["a"]}`},
+		{name: "no previous record", written: `{"namespaces":["a"],"color":"#000"}`, applied: "", kept: []string{"color"}, want: `{"namespaces":["a"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept := map[string]bool{}
+			for _, f := range tt.kept {
+				kept[f] = true
+			}
+			record := o.appliedRecord(rawFields(t, tt.written), rawFields(t, tt.applied), kept)
+			data, _ := json.Marshal(record)
+			if !reflect.DeepEqual(rawFields(t, string(data)), rawFields(t, tt.want)) {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+			// the kept field is still reported as changed in the console on the next sync
+			for f := range kept {
+				if !o.manualChanges(rawFields(t, tt.written), record)[f] {
+					t.Errorf("field %s is no longer detected as changed", f)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	twvulnPolicyAPI = "/api/v1/policies/vulnerability/images"
+	twcompPolicyAPI = "/api/v1/policies/compliance/container"
+)
+
+const (
+	vulnerabilityRuleTemplate = "vulnerability-rule.json"
+	complianceRuleTemplate    = "compliance-rule.json"
+)
+
+// rules created by the controller are named with a prefix, rules without it are never touched
+const defaultRulePrefix = "twistlock-controller-"
+
+// severities maps the severity names used in the annotations to the console threshold values
+var severities = map[string]int{
+	"low":      1,
+	"medium":   4,
+	"high":     7,
+	"critical": 9,
+}
+
+// policyKind is a console policy whose rules are derived from namespace annotations
+type policyKind struct {
+	name        string
+	endpoint    string
+	template    string
+	annotations PolicyAnnotations
+}
+
+// policyRules manages the rules of the collections in the console policies
+type policyRules struct {
+	prefix string
+	kinds  []policyKind
+}
+
+func newPolicyRules(c PolicyConfig) (*policyRules, error) {
+	p := &policyRules{prefix: c.RulePrefix}
+	if len(p.prefix) == 0 {
+		p.prefix = defaultRulePrefix
+	}
+	vuln := c.Vulnerability
+	if len(vuln.AlertAnnotation) == 0 {
+		vuln.AlertAnnotation = "twistlock.io/vuln-alert-threshold"
+	}
+	if len(vuln.BlockAnnotation) == 0 {
+		vuln.BlockAnnotation = "twistlock.io/vuln-block-threshold"
+	}
+	comp := c.Compliance
+	if len(comp.AlertAnnotation) == 0 {
+		comp.AlertAnnotation = "twistlock.io/compliance-alert-threshold"
+	}
+	if len(comp.BlockAnnotation) == 0 {
+		comp.BlockAnnotation = "twistlock.io/compliance-block-threshold"
+	}
+	if vuln.AlertAnnotation == comp.AlertAnnotation || vuln.BlockAnnotation == comp.BlockAnnotation {
+		return nil, fmt.Errorf("Vulnerability and compliance policies need distinct annotations")
+	}
+	p.kinds = []policyKind{
+		{name: "vulnerability", endpoint: twvulnPolicyAPI, template: vulnerabilityRuleTemplate, annotations: vuln},
+		{name: "compliance", endpoint: twcompPolicyAPI, template: complianceRuleTemplate, annotations: comp},
+	}
+	return p, nil
+}
+
+// threshold returns the strictest threshold annotated on the namespaces of a collection,
+// 0 if no namespace carries the annotation
+func threshold(twcoll *TwistlockCollection, annotation string) (int, string) {
+	value, severity := 0, ""
+	for _, ns := range twcoll.Namespaces {
+		name := strings.ToLower(strings.TrimSpace(twcoll.NamespaceMetadata[ns].Annotations[annotation]))
+		if len(name) == 0 {
+			continue
+		}
+		v, ok := severities[name]
+		if !ok {
+			logrus.Warnf("Invalid severity %q in annotation %s of namespace %s", name, annotation, ns)
+			continue
+		}
+		if value == 0 || v < value {
+			value, severity = v, name
+		}
+	}
+	return value, severity
+}
+
+// rule returns the template data of the rule of a collection, nil if none of its namespaces asks for one
+func (p *policyRules) rule(kind policyKind, twcoll *TwistlockCollection) *TwistlockRule {
+	if twcoll == nil {
+		return nil
+	}
+	rule := &TwistlockRule{
+		Name:       p.prefix + twcoll.Name,
+		Collection: twcoll.Name,
+		Cluster:    twcoll.Cluster,
+		Namespaces: twcoll.Namespaces,
+	}
+	rule.AlertThreshold, rule.AlertSeverity = threshold(twcoll, kind.annotations.AlertAnnotation)
+	rule.BlockThreshold, rule.BlockSeverity = threshold(twcoll, kind.annotations.BlockAnnotation)
+	if rule.AlertThreshold == 0 && rule.BlockThreshold == 0 {
+		return nil
+	}
+	// whatever is blocked is alerted as well
+	if rule.AlertThreshold == 0 || (rule.BlockThreshold > 0 && rule.AlertThreshold > rule.BlockThreshold) {
+		rule.AlertThreshold, rule.AlertSeverity = rule.BlockThreshold, rule.BlockSeverity
+	}
+	return rule
+}
+
+// objectName returns the name of a console object decoded as raw fields
+func objectName(obj map[string]json.RawMessage) string {
+	var name string
+	json.Unmarshal(obj["name"], &name)
+	return name
+}
+
+// sameRuleField compares a rule field, the console returns the full collection objects of a rule so collections are compared by name
+func sameRuleField(field string, a, b json.RawMessage) bool {
+	if field != "collections" {
+		return sameField(a, b)
+	}
+	names := func(data json.RawMessage) []string {
+		var colls []struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(data, &colls)
+		var names []string
+		for _, c := range colls {
+			names = append(names, c.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	return reflect.DeepEqual(names(a), names(b))
+}
+
+// sync creates, updates and removes the rules of the given collections in every policy,
+// a nil collection has its rules removed. New rules are inserted first, so they take precedence over the default rules.
+// It returns an error if a policy cannot be read or written.
+func (p *policyRules) sync(ctx context.Context, templates *templateSet, collections map[string]*TwistlockCollection) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	for _, kind := range p.kinds {
+		policyBytes, err := gettwAPI(ctx, kind.endpoint)
+		if err != nil {
+			return err
+		}
+		var policy map[string]json.RawMessage
+		if err := json.Unmarshal(policyBytes, &policy); err != nil {
+			logrus.Warnf("Unable to decode %s policy: %v", kind.name, err)
+			continue
+		}
+		var rules []map[string]json.RawMessage
+		if len(policy["rules"]) > 0 {
+			if err := json.Unmarshal(policy["rules"], &rules); err != nil {
+				logrus.Warnf("Unable to decode %s policy rules: %v", kind.name, err)
+				continue
+			}
+		}
+
+		changed := false
+		for name, twcoll := range collections {
+			rule := p.rule(kind, twcoll)
+			index := -1
+			for i := range rules {
+				if objectName(rules[i]) == p.prefix+name {
+					index = i
+				}
+			}
+
+			if rule == nil {
+				if index >= 0 {
+					logrus.Infof("Removing %s rule of collection %s", kind.name, name)
+					rules = append(rules[:index], rules[index+1:]...)
+					changed = true
+				}
+				continue
+			}
+			rendered, err := templates.render(kind.template, rule)
+			if err != nil {
+				logrus.Warnf("Unable to render %s rule of collection %s: %v", kind.name, name, err)
+				continue
+			}
+			// the rule is always named after the collection, so it can be found again
+			rendered["name"], _ = json.Marshal(rule.Name)
+
+			if index < 0 {
+				logrus.Infof("Creating %s rule of collection %s", kind.name, name)
+				rules = append([]map[string]json.RawMessage{rendered}, rules...)
+				changed = true
+				continue
+			}
+			for f, v := range rendered {
+				if !sameRuleField(f, rules[index][f], v) {
+					logrus.Infof("Updating %s rule of collection %s", kind.name, name)
+					for f, v := range rendered {
+						rules[index][f] = v
+					}
+					changed = true
+					break
+				}
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		policy["rules"], _ = json.Marshal(rules)
+		data, err := json.Marshal(policy)
+		if err != nil {
+			logrus.Warn(err)
+			continue
+		}
+		if err := modifytwAPI(ctx, kind.endpoint, "", string(data)); err != nil {
+			logrus.Warnf("Unable to update %s policy: %v", kind.name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func sampleRule() TwistlockRule {
+	return TwistlockRule{
+		Name:           defaultRulePrefix + "sample",
+		Collection:     "sample",
+		Cluster:        "cluster",
+		Namespaces:     []string{"sample"},
+		AlertThreshold: severities["high"],
+		AlertSeverity:  "high",
+		BlockThreshold: severities["critical"],
+		BlockSeverity:  "critical",
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// etcd key prefixes of the queued keys and of the keys that exhausted their retries,
+// followed by the resource and the namespace/name key
+const (
+	queueKeyPrefix      = "_twistlock-controller/queue/pending/"
+	deadLetterKeyPrefix = "_twistlock-controller/queue/dead/"
+)
+
+// persistentQueue stores the queued keys on the etcd cluster, so keys pending when the controller stops are replayed on startup.
+// The added keys are stored by storeKeys, so the informer callbacks never wait for the etcd cluster.
+// The stored keys are updated with the work context, keys whose removal is aborted on shutdown are replayed on the next start.
+// The etcd cluster is never called while mu is held.
+type persistentQueue struct {
+	workqueue.RateLimitingInterface
+	resource string
+	mu       sync.Mutex
+	// number of times a key was added, a stored key is only removed if it was not added again while it was processed
+	generation map[string]int
+	// keys stored as pending, a key already stored is not stored again
+	stored map[string]storedKey
+	// keys added but not stored yet, storeKeys is woken up through added
+	unstored map[string]QueueItem
+	added    chan struct{}
+	// keys with a dead letter, which is removed once the key is processed successfully
+	dead map[string]bool
+}
+
+// storedKey is a key stored as pending and the etcd revision it was stored at
+type storedKey struct {
+	resync   bool
+	revision int64
+}
+
+func newPersistentQueue(resource string) *persistentQueue {
+	return &persistentQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		resource:              resource,
+		generation:            map[string]int{},
+		stored:                map[string]storedKey{},
+		unstored:              map[string]QueueItem{},
+		added:                 make(chan struct{}, 1),
+		dead:                  map[string]bool{},
+	}
+}
+
+func (q *persistentQueue) storeKey(prefix string, key string) string {
+	return prefix + q.resource + "/" + key
+}
+
+func storeQueueItem(ctx context.Context, etcdKey string, item QueueItem) error {
+	_, err := putQueueItem(ctx, etcdKey, item)
+	return err
+}
+
+// putQueueItem stores an item and returns the etcd revision it was stored at
+func putQueueItem(ctx context.Context, etcdKey string, item QueueItem) (int64, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := kvPut(ctx, etcdKey, string(data))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// listQueueItems returns the items stored under a prefix
+func listQueueItems(ctx context.Context, prefix string) ([]QueueItem, error) {
+	resp, err := kvList(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var items []QueueItem
+	for _, kv := range resp.Kvs {
+		if item, ok := decodeQueueItem(kv); ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func decodeQueueItem(kv *mvccpb.KeyValue) (QueueItem, bool) {
+	var item QueueItem
+	if err := json.Unmarshal(kv.Value, &item); err != nil {
+		logrus.Warnf("Unable to decode queued item %s: %v", kv.Key, err)
+		return item, false
+	}
+	return item, true
+}
+
+// add adds a key to the queue and has it stored by storeKeys. Keys already stored as pending are only stored again
+// if the resync flag has to be recorded.
+func (q *persistentQueue) add(key string, resync bool) {
+	q.mu.Lock()
+	q.generation[key]++
+	stored, ok := q.stored[key]
+	if unstored, pending := q.unstored[key]; pending {
+		unstored.Resync = unstored.Resync || resync
+		q.unstored[key] = unstored
+	} else if !ok || resync && !stored.resync {
+		q.unstored[key] = QueueItem{Resource: q.resource, Key: key, Resync: resync || stored.resync, Enqueued: time.Now()}
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+	q.Add(key)
+}
+
+// addUnstored adds a key to the queue without storing it, for events that are delivered again after a restart
+func (q *persistentQueue) addUnstored(key string) {
+	q.mu.Lock()
+	q.generation[key]++
+	q.mu.Unlock()
+	q.Add(key)
+}
+
+// storeKeys stores the added keys on the etcd cluster until ctx is cancelled
+func (q *persistentQueue) storeKeys(ctx context.Context) {
+	for {
+		select {
+		case <-q.added:
+			q.storeAdded(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// storeAdded stores the keys added since the last call. A key processed while it was stored is removed again.
+func (q *persistentQueue) storeAdded(ctx context.Context) {
+	q.mu.Lock()
+	unstored := q.unstored
+	q.unstored = map[string]QueueItem{}
+	q.mu.Unlock()
+
+	for key, item := range unstored {
+		etcdKey := q.storeKey(queueKeyPrefix, key)
+		revision, err := putQueueItem(ctx, etcdKey, item)
+		if err != nil {
+			logrus.Warnf("Unable to store queued key %s on etcd cluster: %v", key, err)
+			continue
+		}
+		q.mu.Lock()
+		_, queued := q.generation[key]
+		if current := q.stored[key]; queued && revision > current.revision {
+			q.stored[key] = storedKey{resync: item.Resync || current.resync, revision: revision}
+		}
+		q.mu.Unlock()
+		if queued {
+			continue
+		}
+		if _, err := kvDelIf(ctx, etcdKey, revision); err != nil {
+			logrus.Warnf("Unable to remove queued key %s from etcd cluster: %v", key, err)
+		}
+	}
+}
+
+// generationOf returns the generation of a key, taken when its processing starts
+func (q *persistentQueue) generationOf(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.generation[key]
+}
+
+// done removes a processed key from the etcd cluster, unless it was added again meanwhile.
+// The stored key is only deleted if it was not stored again after the key was last added,
+// keys that are not stored yet are not stored anymore.
+func (q *persistentQueue) done(ctx context.Context, key string, generation int) {
+	q.mu.Lock()
+	if q.generation[key] != generation {
+		q.mu.Unlock()
+		return
+	}
+	delete(q.generation, key)
+	delete(q.unstored, key)
+	stored, ok := q.stored[key]
+	delete(q.stored, key)
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+	if _, err := kvDelIf(ctx, q.storeKey(queueKeyPrefix, key), stored.revision); err != nil {
+		logrus.Warnf("Unable to remove queued key %s from etcd cluster: %v", key, err)
+	}
+}
+
+// succeeded removes a processed key from the etcd cluster together with its dead letter
+func (q *persistentQueue) succeeded(ctx context.Context, key string, generation int) {
+	q.done(ctx, key, generation)
+
+	q.mu.Lock()
+	dead := q.dead[key]
+	delete(q.dead, key)
+	q.mu.Unlock()
+	if !dead {
+		return
+	}
+	if _, err := kvDel(ctx, q.storeKey(deadLetterKeyPrefix, key)); err != nil {
+		logrus.Warnf("Unable to remove dead letter %s from etcd cluster: %v", key, err)
+		return
+	}
+	logrus.Infof("Removed dead letter %s of %s, it has been processed successfully", key, q.resource)
+}
+
+// deadLetter moves a key that exhausted its retries to the dead letters
+func (q *persistentQueue) deadLetter(ctx context.Context, key string, generation int, attempts int, resync bool, cause error) {
+	now := time.Now()
+	item := QueueItem{
+		Resource: q.resource,
+		Key:      key,
+		Resync:   resync,
+		Enqueued: now,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Failed:   &now,
+	}
+	// the dead letter keeps the time the key was last queued
+	if resp, err := kvGet(ctx, q.storeKey(queueKeyPrefix, key)); err == nil && len(resp.Kvs) > 0 {
+		var pending QueueItem
+		if json.Unmarshal(resp.Kvs[0].Value, &pending) == nil {
+			item.Enqueued = pending.Enqueued
+		}
+	}
+	if err := storeQueueItem(ctx, q.storeKey(deadLetterKeyPrefix, key), item); err != nil {
+		logrus.Warnf("Unable to store dead letter %s on etcd cluster: %v", key, err)
+	} else {
+		q.mu.Lock()
+		q.dead[key] = true
+		q.mu.Unlock()
+	}
+	q.done(ctx, key, generation)
+}
+
+// pending returns the keys stored on the etcd cluster and remembers them, so they are not stored again when they are replayed
+func (q *persistentQueue) pending(ctx context.Context) ([]QueueItem, error) {
+	resp, err := kvList(ctx, q.storeKey(queueKeyPrefix, ""))
+	if err != nil {
+		return nil, err
+	}
+	var items []QueueItem
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, kv := range resp.Kvs {
+		item, ok := decodeQueueItem(kv)
+		if !ok {
+			continue
+		}
+		q.stored[item.Key] = storedKey{resync: item.Resync, revision: kv.ModRevision}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// deadLetters returns the keys that exhausted their retries and remembers them,
+// so their dead letters are removed once they are processed successfully
+func (q *persistentQueue) deadLetters(ctx context.Context) ([]QueueItem, error) {
+	items, err := listQueueItems(ctx, q.storeKey(deadLetterKeyPrefix, ""))
+	q.mu.Lock()
+	for _, item := range items {
+		q.dead[item.Key] = true
+	}
+	q.mu.Unlock()
+	return items, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPersistentQueueDone(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// run before the stored key is removed or, for unstored keys, before the key is stored
+		interleave func(q *persistentQueue)
+		stored     bool
+		// whether the key is still stored once processed
+		pending bool
+	}{
+		{name: "processed", stored: true, pending: false},
+		{name: "processed before it was stored", stored: false, pending: false},
+		{name: "added again while being removed", stored: true, interleave: func(q *persistentQueue) {
+			q.add("ns/rb", false)
+			q.storeAdded(ctx)
+		}, pending: true},
+		{name: "processed while being stored", stored: false, interleave: func(q *persistentQueue) {
+			q.done(ctx, "ns/rb", q.generationOf("ns/rb"))
+		}, pending: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := useFakeKV()
+			q := newPersistentQueue("rolebindings")
+			defer q.ShutDown()
+
+			q.add("ns/rb", false)
+			if tt.stored {
+				q.storeAdded(ctx)
+			}
+			key, _ := q.Get()
+			generation := q.generationOf("ns/rb")
+			if tt.interleave != nil {
+				kv.before = func() { tt.interleave(q) }
+			}
+			if tt.stored {
+				q.done(ctx, "ns/rb", generation)
+			} else {
+				q.storeAdded(ctx)
+				q.done(ctx, "ns/rb", generation)
+				q.storeAdded(ctx)
+			}
+			q.Done(key)
+
+			keys := kv.keys(queueKeyPrefix)
+			if pending := len(keys) > 0; pending != tt.pending {
+				t.Errorf("got stored keys %v, want pending %v", keys, tt.pending)
+			}
+		})
+	}
+}
+
+func TestPersistentQueueAddDuringProcessing(t *testing.T) {
+	ctx := context.Background()
+	kv := useFakeKV()
+	q := newPersistentQueue("rolebindings")
+	defer q.ShutDown()
+
+	q.add("ns/rb", false)
+	q.storeAdded(ctx)
+	key, _ := q.Get()
+	generation := q.generationOf("ns/rb")
+
+	// the key changes again while it is processed, its stored key has to survive
+	q.add("ns/rb", false)
+	q.storeAdded(ctx)
+	q.done(ctx, "ns/rb", generation)
+	q.Done(key)
+	if keys := kv.keys(queueKeyPrefix); len(keys) != 1 {
+		t.Fatalf("got stored keys %v, want the pending key", keys)
+	}
+
+	// the key is queued again and removed once processed
+	if q.Len() != 1 {
+		t.Fatalf("got %d queued keys, want 1", q.Len())
+	}
+	key, _ = q.Get()
+	q.done(ctx, "ns/rb", q.generationOf("ns/rb"))
+	q.Done(key)
+	if keys := kv.keys(queueKeyPrefix); len(keys) != 0 {
+		t.Errorf("got stored keys %v after processing", keys)
+	}
+}
+
+func TestPersistentQueueReplay(t *testing.T) {
+	ctx := context.Background()
+	kv := useFakeKV()
+	q := newPersistentQueue("rolebindings")
+	q.add("ns/rb", true)
+	q.storeAdded(ctx)
+	q.ShutDown()
+
+	// a replayed key is not stored again, its stored key is removed once processed
+	q = newPersistentQueue("rolebindings")
+	defer q.ShutDown()
+	items, err := q.pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != "ns/rb" || !items[0].Resync {
+		t.Fatalf("got pending items %+v, want ns/rb with resync", items)
+	}
+	revision := kv.rev
+	q.add(items[0].Key, items[0].Resync)
+	q.storeAdded(ctx)
+	if kv.rev != revision {
+		t.Error("replayed key stored again")
+	}
+	key, _ := q.Get()
+	q.done(ctx, "ns/rb", q.generationOf("ns/rb"))
+	q.Done(key)
+	if keys := kv.keys(queueKeyPrefix); len(keys) != 0 {
+		t.Errorf("got stored keys %v after processing", keys)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+var rolebindingResource = rbacv1.SchemeGroupVersion.WithResource("rolebindings")
+
+// rolebindingResourceName is the name of the rolebinding controller, see ResourceConfig.String
+var rolebindingResourceName = rolebindingResource.Resource + "." + rolebindingResource.Group
+
+// legacyResources maps the keys of the former map of booleans to their resources
+var legacyResources = map[string]schema.GroupVersionResource{
+	"pod":                   apiv1.SchemeGroupVersion.WithResource("pods"),
+	"deployment":            appsv1.SchemeGroupVersion.WithResource("deployments"),
+	"replicationcontroller": apiv1.SchemeGroupVersion.WithResource("replicationcontrollers"),
+	"replicaset":            appsv1.SchemeGroupVersion.WithResource("replicasets"),
+	"daemonset":             appsv1.SchemeGroupVersion.WithResource("daemonsets"),
+	"services":              apiv1.SchemeGroupVersion.WithResource("services"),
+	"secret":                apiv1.SchemeGroupVersion.WithResource("secrets"),
+	"configmap":             apiv1.SchemeGroupVersion.WithResource("configmaps"),
+	"rolebinding":           rolebindingResource,
+}
+
+// UnmarshalYAML accepts a list of resources or, for existing configurations,
+// the former map of booleans such as `rolebinding: true`
+func (l *ResourceList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []ResourceConfig
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+	var legacy map[string]bool
+	if err := unmarshal(&legacy); err != nil {
+		return fmt.Errorf("resources must be a list of resources or a map of booleans: %v", err)
+	}
+	var names []string
+	for name, enabled := range legacy {
+		if enabled {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	*l = nil
+	for _, name := range names {
+		gvr, ok := legacyResources[name]
+		if !ok {
+			return fmt.Errorf("Unknown resource %q", name)
+		}
+		*l = append(*l, ResourceConfig{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource})
+	}
+	return nil
+}
+
+// GroupVersionResource returns the resource of the config
+func (r ResourceConfig) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+// String returns the resource name used in logs, e.g. rolebindings.rbac.authorization.k8s.io
+func (r ResourceConfig) String() string {
+	if len(r.Group) == 0 {
+		return r.Resource
+	}
+	return r.Resource + "." + r.Group
+}
+
+// listOptions are the options of the informers of a factory
+type listOptions struct {
+	resync        time.Duration
+	labelSelector string
+	fieldSelector string
+}
+
+// informerFactories holds the factories of the resources watched with the same options
+type informerFactories struct {
+	typed   informers.SharedInformerFactory
+	dynamic dynamicinformer.DynamicSharedInformerFactory
+}
+
+// informerRegistry hands out one shared informer per resource and list options.
+// Built-in resources get typed informers, custom resources are watched through the dynamic client.
+type informerRegistry struct {
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	factories     map[listOptions]*informerFactories
+}
+
+func newInformerRegistry(clientset kubernetes.Interface, dynamicClient dynamic.Interface) *informerRegistry {
+	return &informerRegistry{
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		factories:     map[listOptions]*informerFactories{},
+	}
+}
+
+// factoriesFor returns the factories of the given list options, the selectors are added to every list and watch
+func (r *informerRegistry) factoriesFor(o listOptions) *informerFactories {
+	if f, ok := r.factories[o]; ok {
+		return f
+	}
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = o.labelSelector
+		options.FieldSelector = o.fieldSelector
+	}
+	f := &informerFactories{
+		typed:   informers.NewSharedInformerFactoryWithOptions(r.clientset, o.resync, informers.WithTweakListOptions(tweak)),
+		dynamic: dynamicinformer.NewFilteredDynamicSharedInformerFactory(r.dynamicClient, o.resync, metav1.NamespaceAll, tweak),
+	}
+	r.factories[o] = f
+	return f
+}
+
+// informer returns the shared informer of a resource, after checking the API server serves it and the selectors are valid
+func (r *informerRegistry) informer(res ResourceConfig) (cache.SharedIndexInformer, error) {
+	if _, err := labels.Parse(res.LabelSelector); err != nil {
+		return nil, fmt.Errorf("Invalid label selector %q: %v", res.LabelSelector, err)
+	}
+	if _, err := fields.ParseSelector(res.FieldSelector); err != nil {
+		return nil, fmt.Errorf("Invalid field selector %q: %v", res.FieldSelector, err)
+	}
+	gvr := res.GroupVersionResource()
+	resources, err := r.clientset.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to discover %s: %v", gvr.GroupVersion(), err)
+	}
+	found := false
+	for _, res := range resources.APIResources {
+		if res.Name == gvr.Resource {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Resource %s is not served by %s", gvr.Resource, gvr.GroupVersion())
+	}
+
+	f := r.factoriesFor(listOptions{resync: res.ResyncPeriod, labelSelector: res.LabelSelector, fieldSelector: res.FieldSelector})
+	if generic, err := f.typed.ForResource(gvr); err == nil {
+		return generic.Informer(), nil
+	}
+	return f.dynamic.ForResource(gvr).Informer(), nil
+}
+
+// start runs all informers handed out so far
+func (r *informerRegistry) start(stopCh <-chan struct{}) {
+	for _, f := range r.factories {
+		f.typed.Start(stopCh)
+		f.dynamic.Start(stopCh)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// bindingFilter decides which RoleBindings are synced to Twistlock
+type bindingFilter struct {
+	roleRefs   []rbacv1.RoleRef
+	annotation string
+}
+
+func newBindingFilter(s BindingSelection) (*bindingFilter, error) {
+	f := &bindingFilter{annotation: s.SyncAnnotation}
+	for _, ref := range s.RoleRefs {
+		parts := strings.Split(ref, "/")
+		switch len(parts) {
+		case 1:
+			f.roleRefs = append(f.roleRefs, rbacv1.RoleRef{Name: parts[0]})
+		case 2:
+			if parts[0] != "Role" && parts[0] != "ClusterRole" {
+				return nil, fmt.Errorf("Invalid roleRef kind %q in %q", parts[0], ref)
+			}
+			f.roleRefs = append(f.roleRefs, rbacv1.RoleRef{Kind: parts[0], Name: parts[1]})
+		default:
+			return nil, fmt.Errorf("Invalid roleRef %q, expected <name> or <kind>/<name>", ref)
+		}
+	}
+	return f, nil
+}
+
+// selected reports whether a RoleBinding should be synced.
+// The sync annotation overrides the roleRef list, an empty list selects every RoleBinding.
+// Objects other than RoleBindings are always selected.
+func (f *bindingFilter) selected(obj interface{}) bool {
+	rb, ok := obj.(*rbacv1.RoleBinding)
+	if !ok {
+		return true
+	}
+	switch rb.Annotations[f.annotation] {
+	case "false":
+		return false
+	case "true":
+		return true
+	}
+	if len(f.roleRefs) == 0 {
+		return true
+	}
+	for _, ref := range f.roleRefs {
+		if ref.Name == rb.RoleRef.Name && (len(ref.Kind) == 0 || ref.Kind == rb.RoleRef.Kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBindingFilterSelected(t *testing.T) {
+	tests := []struct {
+		name        string
+		roleRefs    []string
+		roleRef     rbacv1.RoleRef
+		annotations map[string]string
+		selected    bool
+	}{
+		{name: "no roleRefs", roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}, selected: true},
+		{name: "allowed by name", roleRefs: []string{"admin", "edit"}, roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit"}, selected: true},
+		{name: "allowed by name of a role", roleRefs: []string{"edit"}, roleRef: rbacv1.RoleRef{Kind: "Role", Name: "edit"}, selected: true},
+		{name: "allowed by kind and name", roleRefs: []string{"ClusterRole/admin"}, roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "admin"}, selected: true},
+		{name: "denied by name", roleRefs: []string{"admin", "edit"}, roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}, selected: false},
+		{name: "denied by kind", roleRefs: []string{"ClusterRole/admin"}, roleRef: rbacv1.RoleRef{Kind: "Role", Name: "admin"}, selected: false},
+		{name: "annotation opts out", roleRefs: []string{"admin"}, roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "admin"}, annotations: map[string]string{defaultSyncAnnotation: "false"}, selected: false},
+		{name: "annotation opts out without roleRefs", roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "admin"}, annotations: map[string]string{defaultSyncAnnotation: "false"}, selected: false},
+		{name: "annotation opts in", roleRefs: []string{"admin"}, roleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}, annotations: map[string]string{defaultSyncAnnotation: "true"}, selected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newBindingFilter(BindingSelection{RoleRefs: tt.roleRefs, SyncAnnotation: defaultSyncAnnotation})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rb := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "rb", Annotations: tt.annotations}, RoleRef: tt.roleRef}
+			if selected := f.selected(rb); selected != tt.selected {
+				t.Errorf("selected(%s/%s) = %v, want %v", tt.roleRef.Kind, tt.roleRef.Name, selected, tt.selected)
+			}
+		})
+	}
+}
+
+func TestNewBindingFilterInvalid(t *testing.T) {
+	for _, ref := range []string{"Group/admin", "ClusterRole/admin/x"} {
+		if _, err := newBindingFilter(BindingSelection{RoleRefs: []string{ref}}); err == nil {
+			t.Errorf("no error for roleRef %q", ref)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLabelsAnnotation     = "twistlock.io/collection-labels"
+	defaultImagesAnnotation     = "twistlock.io/collection-images"
+	defaultContainersAnnotation = "twistlock.io/collection-containers"
+	defaultRegistriesAnnotation = "twistlock.io/image-registries"
+	defaultInternalRegistry     = "image-registry.openshift-image-registry.svc:5000"
+)
+
+// collectionScoping narrows the labels, images and containers of a collection
+// with the scoping annotations of its namespaces
+type collectionScoping struct {
+	labels     string
+	images     string
+	containers string
+	// registry scoping fills the images with the repositories of the namespaces
+	registryImages   bool
+	internalRegistry string
+	registries       string
+	// host scoping resolves the node selectors of the namespaces
+	nodeHosts    bool
+	nodeSelector string
+}
+
+func newCollectionScoping(c ScopingConfig) *collectionScoping {
+	s := &collectionScoping{
+		labels:           c.LabelsAnnotation,
+		images:           c.ImagesAnnotation,
+		containers:       c.ContainersAnnotation,
+		registryImages:   c.RegistryImages,
+		internalRegistry: strings.TrimSuffix(c.InternalRegistry, "/"),
+		registries:       c.RegistriesAnnotation,
+		nodeHosts:        c.NodeHosts,
+		nodeSelector:     c.NodeSelectorAnnotation,
+	}
+	if len(s.labels) == 0 {
+		s.labels = defaultLabelsAnnotation
+	}
+	if len(s.images) == 0 {
+		s.images = defaultImagesAnnotation
+	}
+	if len(s.containers) == 0 {
+		s.containers = defaultContainersAnnotation
+	}
+	if len(s.internalRegistry) == 0 {
+		s.internalRegistry = defaultInternalRegistry
+	}
+	if len(s.registries) == 0 {
+		s.registries = defaultRegistriesAnnotation
+	}
+	if len(s.nodeSelector) == 0 {
+		s.nodeSelector = defaultNodeSelectorAnnotation
+	}
+	return s
+}
+
+// apply fills the labels, images and containers of a collection.
+// The fields of a collection apply to all of its namespaces, so a field is only
+// narrowed if every namespace of the collection carries the annotation.
+func (s *collectionScoping) apply(twcoll *TwistlockCollection) {
+	twcoll.Labels = s.scope(twcoll, s.labels, labelEntries)
+	if s.registryImages {
+		twcoll.Images = s.registryScope(twcoll)
+	} else {
+		twcoll.Images = s.scope(twcoll, s.images, listEntries)
+	}
+	twcoll.Containers = s.scope(twcoll, s.containers, listEntries)
+	twcoll.Hosts = []string{"*"}
+	if s.nodeHosts {
+		twcoll.Hosts = s.hostScope(twcoll)
+	}
+}
+
+// hostScope returns the nodes matching the node selectors of the namespaces of a collection.
+// As with the annotations, the hosts are only narrowed if every namespace is pinned to nodes.
+func (s *collectionScoping) hostScope(twcoll *TwistlockCollection) []string {
+	var scope []string
+	for _, ns := range twcoll.Namespaces {
+		selector, ok := parseNodeSelector(twcoll.NamespaceMetadata[ns].Annotations, s.nodeSelector)
+		if !ok {
+			return []string{"*"}
+		}
+		nodes := selectedNodes(selector)
+		if len(nodes) == 0 {
+			logrus.Warnf("No node matches the node selector of namespace %s", ns)
+		}
+		for _, node := range nodes {
+			if !sliceContains(scope, node) {
+				scope = append(scope, node)
+			}
+		}
+	}
+	if len(scope) == 0 {
+		return []string{"*"}
+	}
+	sort.Strings(scope)
+	return scope
+}
+
+func (s *collectionScoping) scope(twcoll *TwistlockCollection, annotation string, entries func(string, TemplateNamespace) []string) []string {
+	var scope []string
+	for _, ns := range twcoll.Namespaces {
+		meta := twcoll.NamespaceMetadata[ns]
+		value, ok := meta.Annotations[annotation]
+		if !ok {
+			return []string{"*"}
+		}
+		for _, entry := range entries(value, meta) {
+			if !sliceContains(scope, entry) {
+				scope = append(scope, entry)
+			}
+		}
+	}
+	if len(scope) == 0 {
+		return []string{"*"}
+	}
+	return scope
+}
+
+// registryScope returns the internal registry repository of every namespace of a collection,
+// the external registries and images listed in the namespace annotations
+func (s *collectionScoping) registryScope(twcoll *TwistlockCollection) []string {
+	var scope []string
+	add := func(entry string) {
+		if !sliceContains(scope, entry) {
+			scope = append(scope, entry)
+		}
+	}
+	for _, ns := range twcoll.Namespaces {
+		meta := twcoll.NamespaceMetadata[ns]
+		add(s.internalRegistry + "/" + ns + "/*")
+		for _, registry := range listEntries(meta.Annotations[s.registries], meta) {
+			add(repositoryPattern(registry))
+		}
+		for _, image := range listEntries(meta.Annotations[s.images], meta) {
+			add(image)
+		}
+	}
+	if len(scope) == 0 {
+		return []string{"*"}
+	}
+	return scope
+}
+
+// repositoryPattern matches every image below a registry or repository path, e.g. quay.io/payments/*
+func repositoryPattern(registry string) string {
+	if strings.Contains(registry, "*") {
+		return registry
+	}
+	return strings.TrimSuffix(registry, "/") + "/*"
+}
+
+// listEntries splits a comma separated annotation value
+func listEntries(value string, meta TemplateNamespace) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// labelEntries converts an annotation value like "app=payments,tier" to Twistlock labels.
+// A key without value takes the value of the namespace label with the same key.
+func labelEntries(value string, meta TemplateNamespace) []string {
+	var labels []string
+	for _, entry := range listEntries(value, meta) {
+		switch {
+		case strings.Contains(entry, "="):
+			parts := strings.SplitN(entry, "=", 2)
+			labels = append(labels, strings.TrimSpace(parts[0])+":"+strings.TrimSpace(parts[1]))
+		case strings.Contains(entry, ":"):
+			labels = append(labels, entry)
+		default:
+			v, ok := meta.Labels[entry]
+			if !ok {
+				logrus.Warnf("Namespace %s has no label %s to scope its collection", meta.Name, entry)
+				continue
+			}
+			labels = append(labels, entry+":"+v)
+		}
+	}
+	return labels
+}
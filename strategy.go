@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// one collection per group CN, accumulating all namespaces of the group
+	strategyGroup = "group"
+	// one collection per namespace, shared by all groups with access
+	strategyNamespace = "namespace"
+	// one collection per group and namespace pair
+	strategyGroupNamespace = "groupNamespace"
+)
+
+var defaultNameTemplates = map[string]string{
+	strategyGroup:          "{{ .CN }}",
+	strategyNamespace:      "{{ .Namespace }}",
+	strategyGroupNamespace: "{{ .CN }}-{{ .Namespace }}",
+}
+
+// etcd key of the last applied collection mapping, prefixed with a character
+// that is invalid in namespace names so it never clashes with a RoleBinding key
+const mappingKey = "_twistlock-controller/collection-mapping"
+
+// groupBinding is the access of a single group to a namespace, granted by a RoleBinding
+type groupBinding struct {
+	CN          string
+	Group       string
+	Namespace   string
+	Role        string
+	RoleBinding TemplateRoleBinding
+}
+
+// collectionNameData is passed to the collection name template
+type collectionNameData struct {
+	groupBinding
+	Cluster string
+}
+
+// collectionMapper maps group bindings to Twistlock Collection names
+type collectionMapper struct {
+	CollectionMapping
+	tmpl *template.Template
+}
+
+// newCollectionMapper returns the configured mapping. Controllers sharing a console with other clusters
+// need collection names containing the cluster identifier, the default name templates are prefixed with it.
+func newCollectionMapper(m CollectionMapping) (*collectionMapper, error) {
+	if len(m.NameTemplate) == 0 && len(m.Cluster) > 0 {
+		strategy := m.Strategy
+		if len(strategy) == 0 {
+			strategy = strategyGroup
+		}
+		if tmpl, ok := defaultNameTemplates[strategy]; ok {
+			m.NameTemplate = "{{ .Cluster }}-" + tmpl
+		}
+	}
+	mapper, err := parseCollectionMapper(m)
+	if err != nil || len(m.Cluster) == 0 {
+		return mapper, err
+	}
+	// the sample names only differ in the cluster if the template uses it
+	other := *mapper
+	other.Cluster = m.Cluster + "-other"
+	name, _ := mapper.name(sampleGroupBinding)
+	otherName, _ := other.name(sampleGroupBinding)
+	if name == otherName {
+		return nil, fmt.Errorf("Collection name template %q does not use .Cluster, the collections of other clusters sharing the console would collide", mapper.NameTemplate)
+	}
+	return mapper, nil
+}
+
+// sampleGroupBinding is used to validate the collection name template
+var sampleGroupBinding = groupBinding{CN: "cn", Group: "CN=cn", Namespace: "namespace", Role: "devOps"}
+
+// parseCollectionMapper returns the mapping without checking that it separates clusters,
+// so mappings applied before that check can still be loaded
+func parseCollectionMapper(m CollectionMapping) (*collectionMapper, error) {
+	if len(m.Strategy) == 0 {
+		m.Strategy = strategyGroup
+	}
+	if _, ok := defaultNameTemplates[m.Strategy]; !ok {
+		return nil, fmt.Errorf("Unknown collection strategy %q", m.Strategy)
+	}
+	if len(m.NameTemplate) == 0 {
+		m.NameTemplate = defaultNameTemplates[m.Strategy]
+	}
+	tmpl, err := template.New("collection-name").Funcs(templateFuncs).Option("missingkey=error").Parse(m.NameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid collection name template %q: %v", m.NameTemplate, err)
+	}
+	mapper := &collectionMapper{CollectionMapping: m, tmpl: tmpl}
+	if _, err := mapper.name(sampleGroupBinding); err != nil {
+		return nil, err
+	}
+	return mapper, nil
+}
+
+// name renders the collection name of a group binding
+func (m *collectionMapper) name(b groupBinding) (string, error) {
+	var buf bytes.Buffer
+	if err := m.tmpl.Execute(&buf, collectionNameData{groupBinding: b, Cluster: m.Cluster}); err != nil {
+		return "", fmt.Errorf("Unable to render collection name for %s in %s: %v", b.CN, b.Namespace, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("Collection name for %s in %s is empty", b.CN, b.Namespace)
+	}
+	return buf.String(), nil
+}
+
+// loadCollectionMapper returns the mapping that was applied before the last restart,
+// controllers that never stored one used the group strategy
+func loadCollectionMapper(ctx context.Context) (*collectionMapper, error) {
+	resp, err := kvGet(ctx, mappingKey)
+	if err != nil {
+		return nil, err
+	}
+	var m CollectionMapping
+	if len(resp.Kvs) > 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, &m); err != nil {
+			return nil, err
+		}
+	}
+	return parseCollectionMapper(m)
+}
+
+func storeCollectionMapper(ctx context.Context, m *collectionMapper) error {
+	data, err := json.Marshal(m.CollectionMapping)
+	if err != nil {
+		return err
+	}
+	_, err = kvPut(ctx, mappingKey, string(data))
+	return err
+}
+
+// groupBindings returns the bindings of all group subjects of a RoleBinding
+func groupBindings(role *Rolebinding) []groupBinding {
+	var bindings []groupBinding
+	for i, cn := range role.CN {
+		bindings = append(bindings, groupBinding{
+			CN:        cn,
+			Group:     role.Group[i],
+			Namespace: role.Namespace,
+			Role:      groupRole(role.Group[i]),
+			RoleBinding: TemplateRoleBinding{
+				Name:        role.Name,
+				Namespace:   role.Namespace,
+				RoleRef:     role.RoleRef,
+				Labels:      role.Labels,
+				Annotations: role.Annotations,
+			},
+		})
+	}
+	return bindings
+}
+
+// desiredBindings returns the group bindings of every RoleBinding currently selected for sync
+func desiredBindings(identity *identityMapper) []groupBinding {
+	var bindings []groupBinding
+	if clusterCache == nil || clusterCache.rolebindings == nil {
+		return bindings
+	}
+	rbs, err := clusterCache.rolebindings.List(labels.Everything())
+	if err != nil {
+		logrus.Warnf("Unable to list rolebindings from cache: %v", err)
+		return bindings
+	}
+	for _, rb := range rbs {
+		if !clusterCache.nsFilter.selectedByName(rb.Namespace) || !clusterCache.rbFilter.selected(rb) {
+			continue
+		}
+		bindings = append(bindings, groupBindings(getRolebinding(rb, "sync", identity))...)
+	}
+	return bindings
+}
+
+// names of the rolebinding indexes by the collections and groups their group bindings map to
+const (
+	collectionIndex = "twistlock-collection"
+	groupIndex      = "twistlock-group"
+)
+
+// bindingIndexers index the rolebindings by the collection names and group CNs of their group bindings,
+// so a sync only reads the rolebindings of the collections and groups it touches
+func bindingIndexers(m *collectionMapper, identity *identityMapper) cache.Indexers {
+	bindings := func(obj interface{}) []groupBinding {
+		rb, ok := obj.(*rbacv1.RoleBinding)
+		if !ok {
+			return nil
+		}
+		var bindings []groupBinding
+		for _, b := range groupBindings(getRolebinding(rb, "index", identity)) {
+			if b.Role == "devOps" {
+				bindings = append(bindings, b)
+			}
+		}
+		return bindings
+	}
+	return cache.Indexers{
+		collectionIndex: func(obj interface{}) ([]string, error) {
+			var names []string
+			for _, b := range bindings(obj) {
+				// invalid names are reported when the binding is synced
+				if name, err := m.name(b); err == nil && !sliceContains(names, name) {
+					names = append(names, name)
+				}
+			}
+			return names, nil
+		},
+		groupIndex: func(obj interface{}) ([]string, error) {
+			var cns []string
+			for _, b := range bindings(obj) {
+				if !sliceContains(cns, b.CN) {
+					cns = append(cns, b.CN)
+				}
+			}
+			return cns, nil
+		},
+	}
+}
+
+// scopedBindings returns the group bindings of the rolebindings selected for sync that map to the collections and groups
+// of the scope, or to the other collections of its groups. Without the indexes all selected rolebindings are returned.
+func scopedBindings(scope *syncScope, m *collectionMapper, identity *identityMapper) []groupBinding {
+	if clusterCache == nil || clusterCache.bindings == nil {
+		return desiredBindings(identity)
+	}
+	rbs := map[string]*rbacv1.RoleBinding{}
+	lookup := func(index, value string) bool {
+		objs, err := clusterCache.bindings.ByIndex(index, value)
+		if err != nil {
+			logrus.Warnf("Unable to look up rolebindings of %s: %v", value, err)
+			return false
+		}
+		for _, obj := range objs {
+			rb, ok := obj.(*rbacv1.RoleBinding)
+			if ok && clusterCache.nsFilter.selectedByName(rb.Namespace) && clusterCache.rbFilter.selected(rb) {
+				rbs[rb.Namespace+"/"+rb.Name] = rb
+			}
+		}
+		return true
+	}
+	for name := range scope.collections {
+		if !lookup(collectionIndex, name) {
+			return desiredBindings(identity)
+		}
+	}
+	for cn := range scope.groups {
+		if !lookup(groupIndex, cn) {
+			return desiredBindings(identity)
+		}
+	}
+
+	var bindings []groupBinding
+	for _, rb := range rbs {
+		bindings = append(bindings, groupBindings(getRolebinding(rb, "sync", identity))...)
+	}
+	// the groups reference collections outside of the scope, whose namespaces are part of the group
+	var others []string
+	for _, b := range bindings {
+		if _, ok := scope.groups[b.CN]; !ok || b.Role != "devOps" {
+			continue
+		}
+		if name, err := m.name(b); err == nil && !sliceContains(others, name) {
+			if _, ok := scope.collections[name]; !ok {
+				others = append(others, name)
+			}
+		}
+	}
+	if len(others) == 0 {
+		return bindings
+	}
+	found := len(rbs)
+	for _, name := range others {
+		if !lookup(collectionIndex, name) {
+			return desiredBindings(identity)
+		}
+	}
+	if len(rbs) == found {
+		return bindings
+	}
+	bindings = nil
+	for _, rb := range rbs {
+		bindings = append(bindings, groupBindings(getRolebinding(rb, "sync", identity))...)
+	}
+	return bindings
+}
+
+// syncScope holds the collections and groups touched by an event
+type syncScope struct {
+	// collection name to the namespaces that may have to be added or removed
+	collections map[string][]string
+	// group CN to the collection names that may have to be added or removed
+	groups map[string][]string
+	// group CN to the group DN
+	dns map[string]string
+	// collection name to the group bindings mapped to it
+	bindings map[string][]groupBinding
+}
+
+func newSyncScope() *syncScope {
+	return &syncScope{
+		collections: map[string][]string{},
+		groups:      map[string][]string{},
+		dns:         map[string]string{},
+		bindings:    map[string][]groupBinding{},
+	}
+}
+
+// add records the collection and group touched by a binding under the given mapping
+func (s *syncScope) add(m *collectionMapper, b groupBinding) {
+	if b.Role != "devOps" {
+		return
+	}
+	name, err := m.name(b)
+	if err != nil {
+		logrus.Warn(err)
+		return
+	}
+	if !sliceContains(s.collections[name], b.Namespace) {
+		s.collections[name] = append(s.collections[name], b.Namespace)
+	}
+	if !sliceContains(s.groups[b.CN], name) {
+		s.groups[b.CN] = append(s.groups[b.CN], name)
+	}
+	s.dns[b.CN] = b.Group
+	s.bindings[name] = append(s.bindings[name], b)
+}
+
+// addDesired records the desired namespaces of each collection and collections of each group
+func (s *syncScope) addDesired(m *collectionMapper, bindings []groupBinding) {
+	for _, b := range bindings {
+		s.add(m, b)
+	}
+	for _, v := range s.collections {
+		sort.Strings(v)
+	}
+	for _, v := range s.groups {
+		sort.Strings(v)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// groupRoleBinding returns a RoleBinding of the given role to groups
+func groupRoleBinding(namespace, name, role string, groups ...string) *rbacv1.RoleBinding {
+	rb := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: role},
+	}
+	for _, group := range groups {
+		rb.Subjects = append(rb.Subjects, rbacv1.Subject{Kind: "Group", Name: group})
+	}
+	return rb
+}
+
+func testMapper(t *testing.T, strategy string) (*collectionMapper, *identityMapper) {
+	t.Helper()
+	m, err := newCollectionMapper(CollectionMapping{Strategy: strategy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := newIdentityMapper(IdentityConfig{Mode: identitySAML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, identity
+}
+
+func TestBindingIndexers(t *testing.T) {
+	rb := groupRoleBinding("ns1", "rb", "edit", "team-a", "team-b", "cluster-admins")
+	rb.Subjects = append(rb.Subjects, rbacv1.Subject{Kind: "User", Name: "user"})
+	tests := []struct {
+		strategy    string
+		collections []string
+	}{
+		{strategy: strategyGroup, collections: []string{"team-a", "team-b"}},
+		{strategy: strategyNamespace, collections: []string{"ns1"}},
+		{strategy: strategyGroupNamespace, collections: []string{"team-a-ns1", "team-b-ns1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			indexers := bindingIndexers(testMapper(t, tt.strategy))
+			// admin groups and users get no collections
+			for index, want := range map[string][]string{collectionIndex: tt.collections, groupIndex: {"team-a", "team-b"}} {
+				keys, err := indexers[index](rb)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sort.Strings(keys)
+				if !reflect.DeepEqual(keys, want) {
+					t.Errorf("%s keys are %v, want %v", index, keys, want)
+				}
+				if keys, _ := indexers[index](&apiv1.Namespace{}); len(keys) > 0 {
+					t.Errorf("%s keys of a namespace are %v", index, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestScopedBindings(t *testing.T) {
+	defer func() { clusterCache = nil }()
+	bindings := []*rbacv1.RoleBinding{
+		groupRoleBinding("ns1", "rb", "edit", "team-a"),
+		groupRoleBinding("ns2", "rb", "edit", "team-a"),
+		groupRoleBinding("ns2", "other", "edit", "team-c"),
+		groupRoleBinding("ns3", "rb", "edit", "team-b"),
+		// not selected
+		groupRoleBinding("ns4", "rb", "view", "team-a"),
+		groupRoleBinding("excluded", "rb", "edit", "team-a"),
+	}
+	tests := []struct {
+		strategy string
+		// namespace/CN of the returned group bindings
+		want []string
+	}{
+		{strategy: strategyGroup, want: []string{"ns1/team-a", "ns2/team-a"}},
+		// the other collection ns2 of team-a is synced with all of its groups
+		{strategy: strategyNamespace, want: []string{"ns1/team-a", "ns2/team-a", "ns2/team-c"}},
+		{strategy: strategyGroupNamespace, want: []string{"ns1/team-a", "ns2/team-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			m, identity := testMapper(t, tt.strategy)
+			indexers := bindingIndexers(m, identity)
+			indexers[cache.NamespaceIndex] = cache.MetaNamespaceIndexFunc
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+			namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, rb := range bindings {
+				indexer.Add(rb)
+				namespaces.Add(&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: rb.Namespace}})
+			}
+			nsFilter, err := newNamespaceFilter(NamespaceSelection{Exclude: NamespaceSelector{Names: []string{"excluded"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			nsFilter.lister = listersv1.NewNamespaceLister(namespaces)
+			rbFilter, err := newBindingFilter(BindingSelection{RoleRefs: []string{"edit"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusterCache = &ClusterCache{
+				namespaces:   nsFilter.lister,
+				rolebindings: rbaclisters.NewRoleBindingLister(indexer),
+				bindings:     indexer,
+				nsFilter:     nsFilter,
+				rbFilter:     rbFilter,
+			}
+
+			scope := newSyncScope()
+			for _, b := range groupBindings(getRolebinding(bindings[0], "test", identity)) {
+				scope.add(m, b)
+			}
+			var got []string
+			for _, b := range scopedBindings(scope, m, identity) {
+				got = append(got, b.Namespace+"/"+b.CN)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got bindings %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCollectionMapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping CollectionMapping
+		// collection name of sampleGroupBinding, empty if the mapping is rejected
+		want string
+	}{
+		{name: "no cluster", mapping: CollectionMapping{}, want: "cn"},
+		{name: "cluster prefix", mapping: CollectionMapping{Cluster: "prod"}, want: "prod-cn"},
+		{name: "cluster prefix of namespace strategy", mapping: CollectionMapping{Strategy: strategyNamespace, Cluster: "prod"}, want: "prod-namespace"},
+		{name: "cluster prefix of group namespace strategy", mapping: CollectionMapping{Strategy: strategyGroupNamespace, Cluster: "prod"}, want: "prod-cn-namespace"},
+		{name: "template using the cluster", mapping: CollectionMapping{NameTemplate: "{{ .CN }}@{{ .Cluster }}", Cluster: "prod"}, want: "cn@prod"},
+		{name: "template without the cluster", mapping: CollectionMapping{NameTemplate: "{{ .CN }}", Cluster: "prod"}},
+		{name: "template without the cluster and no cluster", mapping: CollectionMapping{NameTemplate: "team-{{ .CN }}"}, want: "team-cn"},
+		{name: "unknown strategy", mapping: CollectionMapping{Strategy: "project"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newCollectionMapper(tt.mapping)
+			if len(tt.want) == 0 {
+				if err == nil {
+					t.Fatalf("mapping %+v accepted", tt.mapping)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name, _ := m.name(sampleGroupBinding); name != tt.want {
+				t.Errorf("got collection name %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCollectionMapper(t *testing.T) {
+	useFakeKV()
+	ctx := context.Background()
+
+	m, err := loadCollectionMapper(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Strategy != strategyGroup || m.NameTemplate != defaultNameTemplates[strategyGroup] {
+		t.Errorf("got mapping %+v without a stored one, want the group strategy", m.CollectionMapping)
+	}
+
+	// mappings stored before the cluster check are still loaded, so their collections can be migrated
+	stored := CollectionMapping{Strategy: strategyGroup, NameTemplate: "{{ .CN }}", Cluster: "prod"}
+	if _, err := newCollectionMapper(stored); err == nil {
+		t.Fatal("mapping without the cluster accepted")
+	}
+	old, err := parseCollectionMapper(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeCollectionMapper(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	m, err = loadCollectionMapper(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.CollectionMapping != stored {
+		t.Errorf("got mapping %+v, want %+v", m.CollectionMapping, stored)
+	}
+}
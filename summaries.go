@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const twimagesAPI = "/api/v1/images"
+
+// annotations written by the summary job share a prefix, so changing them does not requeue the namespace
+const scanAnnotationPrefix = "twistlock.io/scan-"
+
+const (
+	vulnerabilitiesAnnotation = scanAnnotationPrefix + "vulnerabilities"
+	complianceAnnotation      = scanAnnotationPrefix + "compliance"
+	scanTimeAnnotation        = scanAnnotationPrefix + "time"
+)
+
+const defaultSummaryInterval = time.Hour
+
+// scanSummaries periodically publishes the console scan results of the managed namespaces as namespace annotations
+type scanSummaries struct {
+	interval time.Duration
+	identity *identityMapper
+	pageSize int
+}
+
+func newScanSummaries(c SummaryConfig, identity *identityMapper, pageSize int) *scanSummaries {
+	s := &scanSummaries{interval: c.Interval, identity: identity, pageSize: pageSize}
+	if s.interval <= 0 {
+		s.interval = defaultSummaryInterval
+	}
+	return s
+}
+
+func (d SeverityDistribution) String() string {
+	return fmt.Sprintf("critical=%d,high=%d,medium=%d,low=%d,total=%d", d.Critical, d.High, d.Medium, d.Low, d.Total)
+}
+
+func (d *SeverityDistribution) add(o SeverityDistribution) {
+	d.Critical += o.Critical
+	d.High += o.High
+	d.Medium += o.Medium
+	d.Low += o.Low
+	d.Total += o.Total
+}
+
+// run publishes the summaries right away and then every interval, until the context is cancelled
+func (s *scanSummaries) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.publish(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// annotations returns the summary annotations of a namespace from the scan results of its images
+func (s *scanSummaries) annotations(ctx context.Context, namespace string) (map[string]string, error) {
+	items, err := getPaged(ctx, twimagesAPI+"?namespaces="+url.QueryEscape(namespace), s.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	var vulns, compliance SeverityDistribution
+	var scanTime time.Time
+	for _, item := range items {
+		var image ImageAPI
+		if err := json.Unmarshal(item, &image); err != nil {
+			return nil, err
+		}
+		vulns.add(image.VulnerabilityDistribution)
+		compliance.add(image.ComplianceDistribution)
+		if image.ScanTime.After(scanTime) {
+			scanTime = image.ScanTime
+		}
+	}
+	annotations := map[string]string{
+		vulnerabilitiesAnnotation: vulns.String(),
+		complianceAnnotation:      compliance.String(),
+	}
+	if !scanTime.IsZero() {
+		annotations[scanTimeAnnotation] = scanTime.UTC().Format(time.RFC3339)
+	}
+	return annotations, nil
+}
+
+// publish annotates every managed namespace with its summary and removes the summaries of namespaces no longer managed
+func (s *scanSummaries) publish(ctx context.Context) {
+	if clusterCache == nil || clusterCache.namespaces == nil || clusterCache.client == nil {
+		return
+	}
+	managed := map[string]bool{}
+	for _, b := range desiredBindings(s.identity) {
+		managed[b.Namespace] = true
+	}
+	namespaces, err := clusterCache.namespaces.List(labels.Everything())
+	if err != nil {
+		logrus.Warnf("Unable to list namespaces from cache: %v", err)
+		return
+	}
+	for _, ns := range namespaces {
+		want := map[string]string{}
+		if managed[ns.Name] {
+			want, err = s.annotations(ctx, ns.Name)
+			if err != nil {
+				logrus.Warnf("Unable to get scan results of namespace %s: %v", ns.Name, err)
+				continue
+			}
+		}
+
+		patch := map[string]interface{}{}
+		for k := range ns.Annotations {
+			if _, ok := want[k]; !ok && strings.HasPrefix(k, scanAnnotationPrefix) {
+				patch[k] = nil
+			}
+		}
+		for k, v := range want {
+			if ns.Annotations[k] != v {
+				patch[k] = v
+			}
+		}
+		if len(patch) == 0 {
+			continue
+		}
+		data, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": patch}})
+		if _, err := clusterCache.client.CoreV1().Namespaces().Patch(ns.Name, types.MergePatchType, data); err != nil {
+			logrus.Warnf("Unable to annotate namespace %s with its scan summary: %v", ns.Name, err)
+			continue
+		}
+		logrus.Infof("Scan summary of namespace %s updated", ns.Name)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	collectionTemplate = "collection.json"
+	groupTemplate      = "group.json"
+)
+
+const defaultTemplateReloadInterval = 30 * time.Second
+
+// templateFuncs are the helper functions available in all templates
+var templateFuncs = template.FuncMap{
+	// json encodes a value, strings are quoted and escaped: "name": {{ json .Name }}
+	"json": func(v interface{}) (string, error) {
+		// empty lists are rendered as [] instead of null
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+			return "[]", nil
+		}
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// list builds a list from its arguments: {{ json (list "*") }}
+	"list": func(items ...interface{}) []interface{} {
+		return items
+	},
+	// append adds items to a list of strings: {{ json (append .Namespaces "shared") }}
+	"append": func(list []string, items ...string) []string {
+		return append(append([]string{}, list...), items...)
+	},
+	// join concatenates a list of strings: {{ .Namespaces | join ", " }}
+	"join": func(sep string, list []string) string {
+		return strings.Join(list, sep)
+	},
+	// default returns the first argument if the value is empty: {{ .Labels.team | default "unknown" }}
+	"default": func(def interface{}, v interface{}) interface{} {
+		if isEmptyValue(v) {
+			return def
+		}
+		return v
+	},
+	// keys returns the sorted keys of a string map: {{ json (keys .Labels) }}
+	"keys": func(m map[string]string) []string {
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+	// color returns a deterministic color for a name: {{ json (color .CN) }}
+	"color": teamColor,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// templateSet holds the parsed Twistlock object templates.
+// The templates are parsed and validated once and re-parsed when the files change, e.g. when the mounted ConfigMap is updated.
+type templateSet struct {
+	dir string
+	// template file name to the sample data it is validated with
+	samples   map[string]interface{}
+	mu        sync.RWMutex
+	templates map[string]*template.Template
+	modTimes  map[string]time.Time
+}
+
+func newTemplateSet(dir string, samples map[string]interface{}) (*templateSet, error) {
+	ts := &templateSet{dir: dir, samples: samples}
+	if err := ts.load(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *templateSet) readModTimes() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for name := range ts.samples {
+		info, err := os.Stat(filepath.Join(ts.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		modTimes[name] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (ts *templateSet) parse(name string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ts.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template %s: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// load parses all templates and validates them against sample data,
+// the previous templates are kept if one of them is invalid
+func (ts *templateSet) load() error {
+	modTimes, err := ts.readModTimes()
+	if err != nil {
+		return err
+	}
+	templates := map[string]*template.Template{}
+	for name, sample := range ts.samples {
+		tmpl, err := ts.parse(name)
+		if err != nil {
+			return err
+		}
+		if _, err := execute(tmpl, sample); err != nil {
+			return err
+		}
+		templates[name] = tmpl
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.templates = templates
+	ts.modTimes = modTimes
+	return nil
+}
+
+// watch re-parses the templates whenever one of the files changes, until ctx is cancelled
+func (ts *templateSet) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		modTimes, err := ts.readModTimes()
+		if err != nil {
+			logrus.Warnf("Unable to check templates for changes: %v", err)
+			continue
+		}
+		ts.mu.RLock()
+		changed := !reflect.DeepEqual(modTimes, ts.modTimes)
+		ts.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := ts.load(); err != nil {
+			logrus.Errorf("Keeping previous templates, unable to reload them: %v", err)
+			ts.mu.Lock()
+			ts.modTimes = modTimes
+			ts.mu.Unlock()
+			continue
+		}
+		logrus.Infof("Templates reloaded from %s", ts.dir)
+	}
+}
+
+// execute renders a template and makes sure the result is a JSON object
+func execute(tmpl *template.Template, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("Unable to render template %s: %v", tmpl.Name(), err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return nil, fmt.Errorf("Template %s rendered invalid JSON: %v", tmpl.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// render executes a loaded template and returns the fields of the rendered object
+func (ts *templateSet) render(name string, data interface{}) (map[string]json.RawMessage, error) {
+	ts.mu.RLock()
+	tmpl, ok := ts.templates[name]
+	ts.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Template %s is not loaded", name)
+	}
+	out, err := execute(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(out, &fields)
+	return fields, err
+}
+
+func (ts *templateSet) renderCollection(twcoll TwistlockCollection) (map[string]json.RawMessage, error) {
+	return ts.render(collectionTemplate, twcoll)
+}
+
+func (ts *templateSet) renderGroup(twgroup TwistlockGroup) (map[string]json.RawMessage, error) {
+	return ts.render(groupTemplate, twgroup)
+}
+
+func sampleNamespace() TemplateNamespace {
+	return TemplateNamespace{
+		Name:        "sample",
+		Labels:      map[string]string{"app": "sample"},
+		Annotations: map[string]string{"openshift.io/display-name": "Sample \"project\""},
+	}
+}
+
+func sampleCollection() TwistlockCollection {
+	ns := sampleNamespace()
+	return TwistlockCollection{
+		Name:              "sample",
+		Cluster:           "cluster",
+		CN:                "sample",
+		Group:             "CN=sample,OU=groups,DC=example,DC=com",
+		Groups:            []string{"CN=sample,OU=groups,DC=example,DC=com"},
+		Namespace:         ns.Name,
+		Namespaces:        []string{ns.Name},
+		NamespaceMetadata: map[string]TemplateNamespace{ns.Name: ns},
+		RoleBindings: []TemplateRoleBinding{{
+			Name:      "admin",
+			Namespace: ns.Name,
+			RoleRef:   "ClusterRole/admin",
+		}},
+		Labels:     []string{"app:sample"},
+		Images:     []string{"*"},
+		Containers: []string{"*"},
+		Hosts:      []string{"*"},
+	}
+}
+
+func sampleGroup() TwistlockGroup {
+	return TwistlockGroup{
+		CN:          "sample",
+		Group:       "CN=sample,OU=groups,DC=example,DC=com",
+		Role:        "devOps",
+		Cluster:     "cluster",
+		Collections: []string{"sample"},
+		Namespaces:  []string{"sample"},
+		LdapGroup:   true,
+	}
+}
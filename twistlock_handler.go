@@ -1,23 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
-func getRolebinding(obj interface{}, action string) *Rolebinding {
+func getRolebinding(obj interface{}, action string, identity *identityMapper) *Rolebinding {
 	role := obj.(*rbacv1.RoleBinding)
 	name := role.ObjectMeta.Name
 	namespace := role.ObjectMeta.Namespace
@@ -25,510 +24,873 @@ func getRolebinding(obj interface{}, action string) *Rolebinding {
 
 	var rb *Rolebinding
 	rb = &Rolebinding{
-		Name:      name,
-		Namespace: namespace,
-		Action:    action,
+		Name:        name,
+		Namespace:   namespace,
+		Action:      action,
+		RoleRef:     role.RoleRef.Kind + "/" + role.RoleRef.Name,
+		Labels:      role.Labels,
+		Annotations: role.Annotations,
 	}
 
 	for i := 0; i < len(subjects); i++ {
 		group := subjects[i].Name
 		kind := subjects[i].Kind
 
-		isgroup, err := regexp.MatchString("^CN", group)
-		if err != nil {
-			panic(err.Error())
-		}
-
 		iskind, err := regexp.MatchString("^Group", kind)
 		if err != nil {
 			panic(err.Error())
 		}
 
-		if len(group) > 0 && iskind && isgroup {
-			pattern := `CN=(?P<groupcn>.*?),`
-			pathMetadata := regexp.MustCompile(pattern)
-			matches := pathMetadata.FindStringSubmatch(group)
-			var cn string
-
-			for i, match := range matches {
-				if i != 0 {
-					cn = match
-				}
+		if len(group) > 0 && iskind {
+			// the console group name, depending on the identity mode
+			cn := identity.groupName(group)
+			if len(cn) == 0 {
+				continue
 			}
 			rb.Group = append(rb.Group, group)
 			rb.CN = append(rb.CN, cn)
-
-			if strings.Contains(strings.ToLower(group), "admin") {
-				rb.Role = "admin"
-			} else {
-				rb.Role = "devOps"
-			}
+			rb.Role = groupRole(group)
 		}
 	}
 	return rb
 }
 
-func parseCollection(twc TwistlockCollection) bytes.Buffer {
-	var tmplBytes bytes.Buffer
-	tmpl, err := template.ParseFiles(*configPath + "/twistlock-templates/collection.json")
+// groupRole returns the Twistlock role of a group, only devOps groups get collections
+func groupRole(group string) string {
+	if strings.Contains(strings.ToLower(group), "admin") {
+		return "admin"
+	}
+	return "devOps"
+}
+
+// consoleStatusError is returned for requests the console answered with an unexpected status
+type consoleStatusError struct {
+	method string
+	path   string
+	status int
+}
+
+func (e *consoleStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned status %d", e.method, e.path, e.status)
+}
+
+// isConflict reports whether a write failed because the cached copy of the object was outdated
+func isConflict(err error) bool {
+	e, ok := err.(*consoleStatusError)
+	return ok && (e.status == http.StatusNotFound || e.status == http.StatusConflict)
+}
+
+// gettwAPI returns the body of a successful GET request
+func gettwAPI(ctx context.Context, endpoint string) ([]byte, error) {
+	status, body, err := twClient.do(ctx, "GET", endpoint, "")
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &consoleStatusError{method: "GET", path: endpoint, status: status}
 	}
-	tmpl.Execute(&tmplBytes, twc)
-	return tmplBytes
+	logrus.Info("Data received")
+	return body, nil
 }
 
-func parseGroup(twg TwistlockGroup) bytes.Buffer {
-	var tmplBytes bytes.Buffer
-	tmpl, err := template.ParseFiles(*configPath + "/twistlock-templates/group.json")
+// posttwAPI returns an error if the POST request failed or has not been accepted by the console
+func posttwAPI(ctx context.Context, endpoint string, payload string) error {
+	status, _, err := twClient.do(ctx, "POST", endpoint, payload)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if status < 200 || status > 299 {
+		return &consoleStatusError{method: "POST", path: endpoint, status: status}
 	}
-	tmpl.Execute(&tmplBytes, twg)
-	return tmplBytes
+	logrus.Info("Data has been posted")
+	return nil
 }
 
-func gettwAPI(endpoint string) []byte {
-	var body []byte
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func modifytwAPI(ctx context.Context, endpoint string, obj string, payload string) error {
+	// objects like policies are modified on the endpoint itself
+	path := endpoint
+	if len(obj) > 0 {
+		path += "/" + url.PathEscape(obj)
 	}
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest("GET", twc.Host+endpoint, nil)
+	status, _, err := twClient.do(ctx, "PUT", path, payload)
 	if err != nil {
-		logrus.Warnf("Unable to generate request to %s%s", twc.Host, endpoint)
+		return err
 	}
+	if status < 200 || status > 299 {
+		return &consoleStatusError{method: "PUT", path: path, status: status}
+	}
+	logrus.Info("Data has been modified")
+	return nil
+}
 
-	req.SetBasicAuth(twc.User, twc.Password)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "twistlock-controller")
-
-	resp, err := client.Do(req)
+// deletetwAPI also succeeds if the object is already gone
+func deletetwAPI(ctx context.Context, endpoint string, obj string) error {
+	path := endpoint + "/" + url.PathEscape(obj)
+	status, _, err := twClient.do(ctx, "DELETE", path, "")
 	if err != nil {
-		logrus.Warnf("Unable to get json from %s%s. Error: %s", twc.Host, endpoint, err)
+		return err
 	}
-	defer resp.Body.Close()
-	logrus.Infof("Method: %s, Request: %s, Response: %s, Error: %s", req.Method, req.URL, resp.StatusCode, err)
+	if status == http.StatusNotFound {
+		logrus.Infof("%s has already been deleted", path)
+		return nil
+	}
+	if status < 200 || status > 299 {
+		return &consoleStatusError{method: "DELETE", path: path, status: status}
+	}
+	logrus.Info("Data has been deleted")
+	return nil
+}
+
+// Twistlock handler implements Handler interface,
+type Twistlock struct {
+	mapper    *collectionMapper
+	ownership *fieldOwnership
+	identity  *identityMapper
+	templates *templateSet
+	metadata  *collectionMetadata
+	scoping   *collectionScoping
+	policies  *policyRules
+	alerts    *alertProfiles
+	summaries *scanSummaries
+	locks     *keyedMutex
+	batcher   *syncBatcher
+	console   *consoleCache
+	// interval in which the templates are checked for changes
+	templateReload time.Duration
+	// guards the startup work of CacheSynced
+	synced sync.Once
+}
+
+// stateKeyPrefix prefixes the etcd keys of the synced rolebindings
+var stateKeyPrefix = "_twistlock-controller/state/" + rolebindingResourceName + "/"
 
-	if resp.StatusCode == http.StatusOK {
-		var err error
-		body, err = ioutil.ReadAll(resp.Body)
+// stateKey returns the etcd key of a synced rolebinding
+func stateKey(namespace, name string) string {
+	return stateKeyPrefix + namespace + "/" + name
+}
+
+// Init initializes handler configuration
+func (t *Twistlock) Init(c Config) error {
+	mapping := c.Collections.CollectionMapping
+	mapping.Cluster = c.Cluster
+	mapper, err := newCollectionMapper(mapping)
+	if err != nil {
+		return err
+	}
+	t.mapper = mapper
+	t.locks = newKeyedMutex()
+	t.console = newConsoleCache(c.Console)
+	twClient = newConsoleClient(c.Console)
+	if c.Batching.Window > 0 {
+		t.batcher = newSyncBatcher(c.Batching, t.sync)
+	}
+	ownership, err := newFieldOwnership(c.Collections.OwnedFields, c.Collections.ConflictPolicy)
+	if err != nil {
+		return err
+	}
+	t.ownership = ownership
+	identity, err := newIdentityMapper(c.Identity)
+	if err != nil {
+		return err
+	}
+	t.identity = identity
+	if c.Summaries.Enabled {
+		t.summaries = newScanSummaries(c.Summaries, identity, t.console.pageSize)
+	}
+	t.metadata = newCollectionMetadata(c.Collections.Metadata)
+	t.scoping = newCollectionScoping(c.Collections.Scoping)
+	dir := c.Templates.Path
+	if len(dir) == 0 {
+		dir = *configPath + "/twistlock-templates"
+	}
+	samples := map[string]interface{}{
+		collectionTemplate: sampleCollection(),
+		groupTemplate:      sampleGroup(),
+	}
+	if c.Policies.Enabled {
+		policies, err := newPolicyRules(c.Policies)
 		if err != nil {
-			logrus.Warn("Could not read bytes from body")
+			return err
 		}
+		t.policies = policies
+		samples[vulnerabilityRuleTemplate] = sampleRule()
+		samples[complianceRuleTemplate] = sampleRule()
+	}
+	if c.Alerts.Enabled {
+		t.alerts = newAlertProfiles(c.Alerts)
+		samples[alertProfileTemplate] = sampleAlertProfile()
+	}
+	templates, err := newTemplateSet(dir, samples)
+	if err != nil {
+		return err
+	}
+	t.templates = templates
+	t.templateReload = c.Templates.ReloadInterval
+	if t.templateReload <= 0 {
+		t.templateReload = defaultTemplateReloadInterval
+	}
+	return nil
+}
 
+// ownsCollection reports whether a collection is managed by this controller.
+// Controllers sharing a console only manage the collections of their own cluster,
+// collections not scoped to any cluster are left from before a cluster was configured.
+func (t *Twistlock) ownsCollection(coll *CollectionAPI) bool {
+	if len(t.mapper.Cluster) == 0 || len(coll.Clusters) == 0 {
+		return true
 	}
-	logrus.Info("Data received")
-	return body
+	if len(coll.Clusters) == 1 && coll.Clusters[0] == "*" {
+		return true
+	}
+	return sliceContains(coll.Clusters, t.mapper.Cluster)
+}
+
+// Indexers index the rolebindings by their collections and groups under the configured mapping
+func (t *Twistlock) Indexers() cache.Indexers {
+	return bindingIndexers(t.mapper, t.identity)
 }
 
-func posttwAPI(endpoint string, payload string) int {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// CacheSynced runs the startup work once, it is called by every controller sharing the handler
+func (t *Twistlock) CacheSynced(ctx context.Context) {
+	t.synced.Do(func() { t.startup(ctx) })
+}
+
+// startup starts the template reloads and the scan summaries and migrates the existing collections and groups when the collection mapping changed
+func (t *Twistlock) startup(ctx context.Context) {
+	go t.templates.watch(ctx, t.templateReload)
+	if t.summaries != nil {
+		go t.summaries.run(ctx)
 	}
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest("POST", twc.Host+endpoint, strings.NewReader(payload))
+
+	previous, err := loadCollectionMapper(ctx)
 	if err != nil {
-		logrus.Warnf("Unable to generate request to %s%s", twc.Host, endpoint)
+		logrus.Warnf("Unable to load previous collection mapping: %v", err)
+		return
 	}
-	req.SetBasicAuth(twc.User, twc.Password)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "twistlock-controller")
+	if previous.CollectionMapping == t.mapper.CollectionMapping {
+		return
+	}
+	logrus.Infof("Collection mapping changed from %+v to %+v, migrating collections", previous.CollectionMapping, t.mapper.CollectionMapping)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logrus.Warnf("Could not post json to %s%s, Statuscode: %s, Error: %s", twc.Host, endpoint, resp.StatusCode, err)
+	scope := newSyncScope()
+	for _, b := range desiredBindings(t.identity) {
+		scope.add(previous, b)
+		scope.add(t.mapper, b)
+	}
+	// the previous mapping is kept on failure, so the migration is retried on the next start
+	if err := t.sync(ctx, scope); err != nil {
+		logrus.Warnf("Unable to migrate collections: %v", err)
+		return
+	}
+
+	if err := storeCollectionMapper(ctx, t.mapper); err != nil {
+		logrus.Warnf("Unable to store collection mapping: %v", err)
 	}
-	logrus.Infof("Method: %s, Request: %s, Response: %s, Error: %s", req.Method, req.URL, resp.StatusCode, err)
-	defer resp.Body.Close()
-	logrus.Info("Data has been posted")
-	return resp.StatusCode
 }
 
-func modifytwAPI(endpoint string, obj string, payload string) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// ObjectCreated sends events on object creation.
+// The rolebinding is only stored on the etcd cluster once it is synced, so a failed event is retried.
+func (t *Twistlock) ObjectCreated(ctx context.Context, obj interface{}) error {
+	rb, ok := obj.(*rbacv1.RoleBinding)
+	if !ok {
+		logrus.Warnf("Twistlock handler only handles rolebindings, ignoring %T", obj)
+		return nil
+	}
+	role := getRolebinding(rb, "add", t.identity)
+	scope := newSyncScope()
+	for _, b := range groupBindings(role) {
+		scope.add(t.mapper, b)
 	}
-	client := &http.Client{Transport: tr}
-	safeobj := url.PathEscape(obj)
+	return t.enqueueSync(ctx, scope, func() error {
+		etcdKey := stateKey(rb.Namespace, rb.Name)
+		etcdObj, err := json.Marshal(rb)
+		if err != nil {
+			return err
+		}
+		if _, err := kvPut(ctx, etcdKey, string(etcdObj)); err != nil {
+			return fmt.Errorf("Unable to put %s to etcd cluster: %v", etcdKey, err)
+		}
+		logrus.Info("Rolebinding stored successfully on etcd cluster with key ", etcdKey)
+		return nil
+	})
+}
 
-	req, err := http.NewRequest("PUT", twc.Host+endpoint+"/"+safeobj, strings.NewReader(payload))
-	if err != nil {
-		logrus.Warnf("Unable to generate request to %s%s%s%s", twc.Host, endpoint, "/", safeobj)
+// ObjectUpdated sends events on object updation, the old object is the one stored on the etcd cluster
+func (t *Twistlock) ObjectUpdated(ctx context.Context, oldObj, newObj interface{}) error {
+	newRb, newOk := newObj.(*rbacv1.RoleBinding)
+	oldRb, oldOk := oldObj.(*rbacv1.RoleBinding)
+	if !newOk || !oldOk {
+		logrus.Warnf("Twistlock handler only handles rolebindings, ignoring %T", newObj)
+		return nil
+	}
+	newRole := getRolebinding(newRb, "update", t.identity)
+	oldRole := getRolebinding(oldRb, "update", t.identity)
+	// an unchanged rolebinding comes from a resync, its collections and groups are checked for drift
+	unchanged := oldRb.ResourceVersion == newRb.ResourceVersion
+	if unchanged {
+		logrus.Infof("Checking collections of rolebinding %s/%s for drift", newRb.Namespace, newRb.Name)
 	}
-	req.SetBasicAuth(twc.User, twc.Password)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "twistlock-controller")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logrus.Warnf("Could not post json to %s%s, Statuscode: %s, Error: %s", twc.Host, endpoint, resp.StatusCode, err)
+	// groups added to or removed from the rolebinding are both part of the scope,
+	// the desired state decides whether their namespace is added or removed
+	scope := newSyncScope()
+	for _, b := range append(groupBindings(oldRole), groupBindings(newRole)...) {
+		scope.add(t.mapper, b)
 	}
-	logrus.Infof("Method: %s, Request: %s, Response: %s, Error: %s", req.Method, req.URL, resp.StatusCode, err)
-	defer resp.Body.Close()
-	logrus.Info("Data has been modified")
+	return t.enqueueSync(ctx, scope, func() error {
+		if unchanged {
+			return nil
+		}
+		etcdKey := stateKey(newRole.Namespace, newRole.Name)
+		etcdObj, err := json.Marshal(newRb)
+		if err != nil {
+			return err
+		}
+		if _, err := kvPut(ctx, etcdKey, string(etcdObj)); err != nil {
+			return fmt.Errorf("Unable to put %s to etcd cluster: %v", etcdKey, err)
+		}
+		logrus.Info("Rolebinding updated successfully on etcd cluster with key ", etcdKey)
+		return nil
+	})
 }
 
-func deletetwAPI(endpoint string, obj string) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// ObjectDeleted sends events on object deletion, the object is the one stored on the etcd cluster
+func (t *Twistlock) ObjectDeleted(ctx context.Context, obj interface{}) error {
+	rb, ok := obj.(*rbacv1.RoleBinding)
+	if !ok {
+		logrus.Warnf("Twistlock handler only handles rolebindings, ignoring %T", obj)
+		return nil
 	}
-	client := &http.Client{Transport: tr}
-	safeobj := url.PathEscape(obj)
-	req, err := http.NewRequest("DELETE", twc.Host+endpoint+"/"+safeobj, nil)
-	if err != nil {
-		logrus.Warnf("Unable to generate request to %s%s%s%s", twc.Host, endpoint, "/", safeobj)
+	etcdKey := stateKey(rb.Namespace, rb.Name)
+	role := getRolebinding(rb, "delete", t.identity)
+
+	scope := newSyncScope()
+	for _, b := range groupBindings(role) {
+		scope.add(t.mapper, b)
 	}
-	req.SetBasicAuth(twc.User, twc.Password)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "twistlock-controller")
+	return t.enqueueSync(ctx, scope, func() error {
+		if _, err := kvDel(ctx, etcdKey); err != nil {
+			return fmt.Errorf("Unable to delete %s from etcd cluster: %v", etcdKey, err)
+		}
+		logrus.Info("Rolebinding deleted successfully from etcd cluster with key ", etcdKey)
+		return nil
+	})
+}
 
-	resp, err := client.Do(req)
+// LastState returns the rolebinding stored on the etcd cluster, nil if it has not been synced.
+// Only rolebindings are stored, a rolebinding stored under its key of earlier versions is moved to its current key.
+func (t *Twistlock) LastState(ctx context.Context, resource string, key string) (interface{}, error) {
+	if resource != rolebindingResourceName {
+		return nil, nil
+	}
+	etcdKey := stateKeyPrefix + key
+	etcdObj, err := kvGet(ctx, etcdKey)
 	if err != nil {
-		logrus.Warnf("Could not delete obj %s, Statuscode: %s, Error: %s", obj, resp.StatusCode, err)
+		return nil, err
 	}
-	logrus.Infof("Method: %s, Request: %s, Response: %s, Error: %s", req.Method, req.URL, resp.StatusCode, err)
-	defer resp.Body.Close()
-	logrus.Info("Data has been deleted")
+	legacy := len(etcdObj.Kvs) == 0
+	if legacy {
+		if etcdObj, err = kvGet(ctx, key); err != nil {
+			return nil, err
+		}
+		if len(etcdObj.Kvs) == 0 {
+			return nil, nil
+		}
+	}
+	var rb *rbacv1.RoleBinding
+	if err := json.Unmarshal(etcdObj.Kvs[0].Value, &rb); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal rolebinding %s: %v", key, err)
+	}
+	if legacy {
+		if _, err := kvPut(ctx, etcdKey, string(etcdObj.Kvs[0].Value)); err != nil {
+			return nil, fmt.Errorf("Unable to put %s to etcd cluster: %v", etcdKey, err)
+		}
+		if _, err := kvDel(ctx, key); err != nil {
+			logrus.Warnf("Unable to delete %s from etcd cluster: %v", key, err)
+		}
+		logrus.Infof("Rolebinding moved from etcd key %s to %s", key, etcdKey)
+	}
+	return rb, nil
 }
 
-// Twistlock handler implements Handler interface,
-type Twistlock struct {
+// Shutdown flushes the pending batches before the controller exits
+func (t *Twistlock) Shutdown(ctx context.Context) error {
+	if t.batcher == nil {
+		return nil
+	}
+	return t.batcher.flushAll(ctx)
 }
 
-// Init initializes handler configuration
-// Do nothing for default handler
-func (t *Twistlock) Init(c Config) error {
+// Paused pauses the workers while the circuit breaker of the console is open
+func (t *Twistlock) Paused() time.Duration {
+	return twClient.breaker.remaining()
+}
 
-	return nil
+// enqueueSync adds the scope of an event to the batches, or syncs it right away if batching is disabled.
+// The rolebinding is stored by commit once its scope is synced, a batched event is completed after its batches are flushed.
+func (t *Twistlock) enqueueSync(ctx context.Context, scope *syncScope, commit func() error) error {
+	if done := completionOf(ctx); t.batcher != nil && done != nil {
+		t.batcher.add(scope, func(err error) {
+			if err == nil {
+				err = commit()
+			}
+			done(err)
+		})
+		return errDeferred
+	}
+	if err := t.sync(ctx, scope); err != nil {
+		return err
+	}
+	return commit()
 }
 
-// ObjectCreated sends events on object creation
-func (t *Twistlock) ObjectCreated(obj interface{}) {
-	etcdKey := fmt.Sprintf("%s/%s", obj.(*rbacv1.RoleBinding).Namespace, obj.(*rbacv1.RoleBinding).Name)
-	etcdObj, err := json.Marshal(obj.(*rbacv1.RoleBinding))
-	if err != nil {
-		logrus.Warn(err)
+// sync brings the collections and groups touched by an event in line with the desired state.
+// Only the touched namespaces and collections are added or removed, so entries added
+// manually in the console are kept. The sync is stopped with an error if the console is unavailable,
+// it converges again when retried.
+func (t *Twistlock) sync(ctx context.Context, scope *syncScope) error {
+	if len(scope.collections) == 0 && len(scope.groups) == 0 {
+		return nil
+	}
+	// the collections and groups are read, modified and written back as a whole,
+	// workers touching the same objects wait for each other
+	var keys []string
+	for name := range scope.collections {
+		keys = append(keys, "collection/"+name)
+	}
+	for cn := range scope.groups {
+		keys = append(keys, "group/"+cn)
 	}
+	unlock := t.locks.lock(keys...)
+	defer unlock()
 
-	_, err = kvPut(etcdKey, string(etcdObj))
+	desired := newSyncScope()
+	desired.addDesired(t.mapper, scopedBindings(scope, t.mapper, t.identity))
+
+	collections, groups, err := t.console.snapshot(ctx)
 	if err != nil {
-		logrus.Warnf("Unable to put %s to etcd cluster", etcdKey)
-	} else {
-		logrus.Info("Rolebinding stored successfully on etcd cluster with key ", etcdKey)
+		return err
 	}
 
-	role := getRolebinding(obj, "add")
-	for _, cn := range role.CN {
-		twcoll := TwistlockCollection{
-			CN:        cn,
-			Namespace: role.Namespace,
-		}
-		if role.Role == "devOps" {
-			var collExists *bool
-			collBytes := gettwAPI(twcollAPI)
-			if len(collBytes) > 0 {
-				var collections []CollectionAPI
-				err := json.Unmarshal(collBytes, &collections)
-				if err != nil {
-					logrus.Warn(err)
-				}
-				for i := 0; i < len(collections); i++ {
-					if collections[i].Name == twcoll.CN {
-						logrus.Infof("Collection %s already exists", collections[i])
-						if !sliceContains(collections[i].Namespaces, twcoll.Namespace) {
-							t := true
-							collExists = &t
-							logrus.Infof("Adding namespace %s to collection %s", twcoll.Namespace, collections[i].Name)
-							collections[i].Namespaces = append(collections[i].Namespaces, twcoll.Namespace)
-							data, _ := json.Marshal(collections[i])
-							modifytwAPI(twcollAPI, collections[i].Name, string(data))
-							break
-						} else {
-							t := true
-							collExists = &t
-							break
-						}
-					} else {
-						f := false
-						collExists = &f
-					}
-				}
-			}
-			if !*collExists {
-				logrus.Infof("Creating Collection %s", twcoll.CN)
-				twObj := parseCollection(twcoll)
-				jsonObj := twObj.String()
-				s := posttwAPI(twcollAPI, jsonObj)
-				if s >= 200 && s <= 299 {
-					logrus.Info("Collection posted successfully")
-				} else {
-					logrus.Info("Unable to post collection")
-				}
+	// collections are created before the groups referencing them,
+	// and deleted after the groups no longer reference them
+	var obsolete []string
+	for name, namespaces := range scope.collections {
+		keep, err := t.syncCollection(ctx, collections, name, namespaces, desired)
+		if isConflict(err) {
+			// the cached collection was outdated, the write is retried once with a refreshed cache
+			logrus.Warnf("Collection %s has been changed in the console, retrying: %v", name, err)
+			if collections, groups, err = t.console.snapshot(ctx); err == nil {
+				keep, err = t.syncCollection(ctx, collections, name, namespaces, desired)
 			}
+		}
+		if err != nil {
+			return err
+		}
+		if !keep {
+			obsolete = append(obsolete, name)
+		}
+	}
 
+	for cn, names := range scope.groups {
+		err := t.syncGroup(ctx, groups, collections, cn, names, desired)
+		if isConflict(err) {
+			logrus.Warnf("Group %s has been changed in the console, retrying: %v", cn, err)
+			if collections, groups, err = t.console.snapshot(ctx); err == nil {
+				err = t.syncGroup(ctx, groups, collections, cn, names, desired)
+			}
+		}
+		if err != nil {
+			return err
 		}
 	}
-	for i, group := range role.Group {
-		twgroup := TwistlockGroup{
-			CN:    role.CN[i],
-			Group: group,
-			Role:  role.Role,
-		}
-		if twgroup.Role == "devOps" {
-			var grpExits *bool
-			groupBytes := gettwAPI(twgrpAPI)
-			if len(groupBytes) > 0 {
-				var groups []GroupAPI
-				err := json.Unmarshal(groupBytes, &groups)
-				if err != nil {
-					logrus.Warn(err)
-				}
-				for i := 0; i < len(groups); i++ {
-					if groups[i].GroupName == twgroup.CN {
-						t := true
-						grpExits = &t
-						logrus.Infof("Group %s already exists", groups[i])
-						break
-					} else {
-						f := false
-						grpExits = &f
-					}
-				}
+
+	// rules and alert profiles are removed before their collections are deleted, the console refuses to delete collections in use
+	if t.policies != nil || t.alerts != nil {
+		ruled := t.ruleCollections(scope, collections, desired, obsolete)
+		if t.policies != nil {
+			if err := t.syncPolicies(ctx, ruled); err != nil {
+				return err
 			}
-			if !*grpExits {
-				logrus.Infof("Creating Group %s", twgroup.CN)
-				twObj := parseGroup(twgroup)
-				jsonObj := twObj.String()
-				s := posttwAPI(twgrpAPI, jsonObj)
-				if s >= 200 && s <= 299 {
-					logrus.Info("Group posted successfully")
-				} else {
-					logrus.Info("Unable to post group")
-				}
+		}
+		if t.alerts != nil {
+			if err := t.alerts.sync(ctx, t.templates, ruled); err != nil {
+				return err
 			}
+		}
+	}
+
+	for _, name := range obsolete {
+		logrus.Infof("Deleting collection %s", name)
+		if err := deletetwAPI(ctx, twcollAPI, name); err != nil {
+			t.console.invalidate()
+			return err
+		}
+		t.console.removeCollection(name)
+		if err := deleteApplied(ctx, name); err != nil {
+			logrus.Warnf("Unable to delete applied fields of collection %s: %v", name, err)
+		}
+	}
+	return nil
+}
 
+// ruleCollections returns the touched collections managed by this controller for their rules and alert profiles,
+// nil for the ones without namespaces whose rules have to be removed
+func (t *Twistlock) ruleCollections(scope *syncScope, collections []CollectionAPI, desired *syncScope, obsolete []string) map[string]*TwistlockCollection {
+	ruled := map[string]*TwistlockCollection{}
+	for name := range scope.collections {
+		if existing := findCollection(collections, name); existing != nil && !t.ownsCollection(existing) {
+			continue
 		}
+		if sliceContains(obsolete, name) || len(desired.collections[name]) == 0 {
+			ruled[name] = nil
+			continue
+		}
+		twcoll := t.collectionData(name, desired)
+		ruled[name] = &twcoll
 	}
+	return ruled
 }
 
-// ObjectUpdated sends events on object updation
-func (t *Twistlock) ObjectUpdated(obj interface{}) {
-	var add []string
-	var del []string
-	newRole := getRolebinding(obj.(Event).newObj, "update")
-	oldRole := getRolebinding(obj.(Event).oldObj, "update")
+func findCollection(collections []CollectionAPI, name string) *CollectionAPI {
+	for i := range collections {
+		if collections[i].Name == name {
+			return &collections[i]
+		}
+	}
+	return nil
+}
 
-	etcdKey := fmt.Sprintf("%s/%s", newRole.Namespace, newRole.Name)
-	etcdObj, err := json.Marshal(newRole)
+// collectionData returns the template data of a collection in the desired state
+func (t *Twistlock) collectionData(name string, desired *syncScope) TwistlockCollection {
+	want := desired.collections[name]
+	twcoll := TwistlockCollection{
+		Name:              name,
+		Cluster:           t.mapper.Cluster,
+		Namespaces:        want,
+		NamespaceMetadata: map[string]TemplateNamespace{},
+	}
+	if len(want) > 0 {
+		twcoll.Namespace = want[0]
+	}
+	var cns []string
+	for _, b := range desired.bindings[name] {
+		if !sliceContains(cns, b.CN) {
+			cns = append(cns, b.CN)
+		}
+		if !sliceContains(twcoll.Groups, b.Group) {
+			twcoll.Groups = append(twcoll.Groups, b.Group)
+		}
+		twcoll.RoleBindings = append(twcoll.RoleBindings, b.RoleBinding)
+	}
+	// the CN is only known if a single group maps to the collection
+	if len(cns) == 1 {
+		twcoll.CN = cns[0]
+		twcoll.Group = twcoll.Groups[0]
+	}
+	for _, ns := range want {
+		twcoll.NamespaceMetadata[ns] = namespaceMetadata(ns)
+	}
+	t.metadata.apply(&twcoll)
+	t.scoping.apply(&twcoll)
+	return twcoll
+}
+
+// namespaceMetadata returns the labels and annotations of a namespace from the informer cache
+func namespaceMetadata(name string) TemplateNamespace {
+	meta := TemplateNamespace{Name: name}
+	if clusterCache == nil || clusterCache.namespaces == nil {
+		return meta
+	}
+	ns, err := clusterCache.namespaces.Get(name)
 	if err != nil {
-		logrus.Warn(err)
+		logrus.Warnf("Unable to get namespace %s from cache: %v", name, err)
+		return meta
 	}
+	meta.Labels = ns.Labels
+	meta.Annotations = ns.Annotations
+	return meta
+}
 
-	_, err = kvPut(etcdKey, string(etcdObj))
+// renderCollection renders the collection template and returns its fields
+func (t *Twistlock) renderCollection(name string, desired *syncScope) (map[string]json.RawMessage, error) {
+	fields, err := t.templates.renderCollection(t.collectionData(name, desired))
 	if err != nil {
-		logrus.Warnf("Unable to put %s to etcd cluster", etcdKey)
-	} else {
-		logrus.Info("Rolebinding updated successfully on etcd cluster with key ", etcdKey)
+		return nil, fmt.Errorf("Unable to render collection %s: %v", name, err)
 	}
+	return fields, nil
+}
 
-	for _, cn := range oldRole.CN {
-		c := sliceContains(newRole.CN, cn)
-		if !c {
-			logrus.Info("This group got deleted: ", cn)
-			del = append(del, cn)
-		}
-	}
-	for _, cn := range newRole.CN {
-		c := sliceContains(oldRole.CN, cn)
-		if !c {
-			logrus.Info("This group got added: ", cn)
-			add = append(add, cn)
-		}
-	}
-
-	if len(del) > 0 {
-		for _, cn := range del {
-			if newRole.Role == "devOps" {
-				collBytes := gettwAPI(twcollAPI)
-				if len(collBytes) > 0 {
-					var collections []CollectionAPI
-					err := json.Unmarshal(collBytes, &collections)
-					if err != nil {
-						logrus.Warn(err)
-					}
-					for i := 0; i < len(collections); i++ {
-						if collections[i].Name == cn {
-							ns := len(collections[i].Namespaces)
-
-							if ns <= 1 && sliceContains(collections[i].Namespaces, newRole.Namespace) {
-								logrus.Infof("%s is the only namespace in collection %s", newRole.Namespace, collections[i].Name)
-								logrus.Infof("Deleting Group %s", cn)
-								deletetwAPI(twgrpAPI, cn)
-								logrus.Infof("Deleting collection %s", cn)
-								deletetwAPI(twcollAPI, cn)
-							} else if ns > 1 && sliceContains(collections[i].Namespaces, newRole.Namespace) {
-								logrus.Infof("Removing namespace %s from collection %s", newRole.Namespace, collections[i].Name)
-								collections[i].Namespaces = sliceRemove(collections[i].Namespaces, newRole.Namespace)
-								data, _ := json.Marshal(collections[i])
-								modifytwAPI(twcollAPI, collections[i].Name, string(data))
-							}
-						}
-					}
-
-				}
-			}
+// syncCollection adds or removes the touched namespaces of a collection and updates the other owned fields.
+// Fields not owned by the controller are sent back to the console as received.
+// It returns false if the collection has no namespaces left and has to be deleted,
+// and an error if the console is unavailable.
+func (t *Twistlock) syncCollection(ctx context.Context, collections []CollectionAPI, name string, touched []string, desired *syncScope) (bool, error) {
+	want := desired.collections[name]
+
+	existing := findCollection(collections, name)
+
+	if existing == nil {
+		if len(want) == 0 {
+			return true, nil
+		}
+		rendered, err := t.renderCollection(name, desired)
+		if err != nil {
+			logrus.Warn(err)
+			return true, nil
 		}
+		data, _ := json.Marshal(rendered)
+		logrus.Infof("Creating Collection %s", name)
+		if err := posttwAPI(ctx, twcollAPI, string(data)); err != nil {
+			logrus.Info("Unable to post collection")
+			t.console.invalidate()
+			return true, err
+		}
+		logrus.Info("Collection posted successfully")
+		t.console.storeCollection(data)
+		if err := storeApplied(ctx, name, t.ownership.owned(rendered)); err != nil {
+			logrus.Warnf("Unable to store applied fields of collection %s: %v", name, err)
+		}
+		return true, nil
 	}
 
-	if len(add) > 0 {
-		for _, cn := range add {
-			twcoll := TwistlockCollection{
-				CN:        cn,
-				Namespace: newRole.Namespace,
-			}
-			if newRole.Role == "devOps" {
-				var collExists *bool
-				collBytes := gettwAPI(twcollAPI)
-				if len(collBytes) > 0 {
-					var collections []CollectionAPI
-					err := json.Unmarshal(collBytes, &collections)
-					if err != nil {
-						logrus.Warn(err)
-					}
-					for i := 0; i < len(collections); i++ {
-						if collections[i].Name == twcoll.CN {
-							logrus.Infof("Collection %s already exists", collections[i])
-							if !sliceContains(collections[i].Namespaces, twcoll.Namespace) {
-								t := true
-								collExists = &t
-								logrus.Infof("Adding namespace %s to collection %s", twcoll.Namespace, collections[i].Name)
-								collections[i].Namespaces = append(collections[i].Namespaces, twcoll.Namespace)
-								data, _ := json.Marshal(collections[i])
-								modifytwAPI(twcollAPI, collections[i].Name, string(data))
-								break
-							} else {
-								t := true
-								collExists = &t
-								break
-							}
-						} else {
-							f := false
-							collExists = &f
-						}
-					}
-				}
-				if !*collExists {
-					logrus.Infof("Creating Collection %s", twcoll.CN)
-					twObj := parseCollection(twcoll)
-					jsonObj := twObj.String()
-					s := posttwAPI(twcollAPI, jsonObj)
-					if s >= 200 && s <= 299 {
-						logrus.Info("Collection posted successfully")
-					} else {
-						logrus.Info("Unable to post collection")
-					}
-				}
+	logrus.Infof("Collection %s already exists", existing.Name)
+	if !t.ownsCollection(existing) {
+		logrus.Warnf("Collection %s is managed by the clusters %v, skipping", existing.Name, existing.Clusters)
+		return true, nil
+	}
 
+	applied, err := loadApplied(ctx, name)
+	if err != nil {
+		return true, fmt.Errorf("Unable to load applied fields of collection %s: %v", name, err)
+	}
+	manual := t.ownership.manualChanges(existing.raw, applied)
+	if t.ownership.policy == conflictSkip && len(manual) > 0 {
+		logrus.Warnf("Fields %v of collection %s have been changed in the console, skipping", mapKeys(manual), name)
+		return true, nil
+	}
+
+	namespaces := append([]string{}, existing.Namespaces...)
+	if t.ownership.policy == conflictOverride {
+		namespaces = want
+	} else {
+		for _, ns := range touched {
+			switch {
+			case sliceContains(want, ns) && !sliceContains(namespaces, ns):
+				logrus.Infof("Adding namespace %s to collection %s", ns, existing.Name)
+				namespaces = append(namespaces, ns)
+			case !sliceContains(want, ns) && sliceContains(namespaces, ns):
+				logrus.Infof("Removing namespace %s from collection %s", ns, existing.Name)
+				namespaces = sliceRemove(namespaces, ns)
 			}
 		}
-		for _, group := range add {
-			twgroup := TwistlockGroup{
-				CN:   group,
-				Role: newRole.Role,
-			}
-			if twgroup.Role == "devOps" {
-				var grpExits *bool
-				groupBytes := gettwAPI(twgrpAPI)
-				if len(groupBytes) > 0 {
-					var groups []GroupAPI
-					err := json.Unmarshal(groupBytes, &groups)
-					if err != nil {
-						logrus.Warn(err)
-					}
-					for i := 0; i < len(groups); i++ {
-						if groups[i].GroupName == twgroup.CN {
-							t := true
-							grpExits = &t
-							logrus.Infof("Group %s already exists", groups[i])
-							break
-						} else {
-							f := false
-							grpExits = &f
-						}
-					}
-				}
-				if !*grpExits {
-					logrus.Infof("Creating Group %s", twgroup.CN)
-					twObj := parseGroup(twgroup)
-					jsonObj := twObj.String()
-					s := posttwAPI(twgrpAPI, jsonObj)
-					if s >= 200 && s <= 299 {
-						logrus.Info("Group posted successfully")
-					} else {
-						logrus.Info("Unable to post group")
-					}
-				}
+	}
+	if len(namespaces) == 0 {
+		logrus.Infof("No namespace left in collection %s", existing.Name)
+		return false, nil
+	}
 
+	update := map[string]json.RawMessage{}
+	update["namespaces"], _ = json.Marshal(namespaces)
+	kept := map[string]bool{}
+	if len(t.ownership.fields) > 1 {
+		rendered, err := t.renderCollection(name, desired)
+		if err != nil {
+			logrus.Warn(err)
+			return true, nil
+		}
+		for _, f := range t.ownership.fields {
+			if f == "namespaces" {
+				continue
+			}
+			if t.ownership.policy == conflictMerge && manual[f] {
+				logrus.Infof("Keeping field %s of collection %s changed in the console", f, name)
+				kept[f] = true
+				continue
+			}
+			if v, ok := rendered[f]; ok {
+				update[f] = v
 			}
 		}
 	}
-}
 
-// ObjectDeleted sends events on object deletion
-func (t *Twistlock) ObjectDeleted(obj interface{}) {
-	etcdKey := obj.(string)
-	etcdObj, err := kvGet(etcdKey)
+	changed := false
+	for f, v := range update {
+		if !sameField(existing.raw[f], v) {
+			changed = true
+		}
+	}
+	if !changed {
+		return true, nil
+	}
+	data, err := mergeFields(existing.raw, update)
 	if err != nil {
-		logrus.Warnf("Unable to get %s from etcd cluster", etcdKey)
+		logrus.Warn(err)
+		return true, nil
+	}
+	if err := modifytwAPI(ctx, twcollAPI, existing.Name, string(data)); err != nil {
+		t.console.invalidate()
+		return true, err
+	}
+	t.console.storeCollection(data)
+	var written map[string]json.RawMessage
+	json.Unmarshal(data, &written)
+	if err := storeApplied(ctx, name, t.ownership.appliedRecord(written, applied, kept)); err != nil {
+		logrus.Warnf("Unable to store applied fields of collection %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// syncPolicies updates the rules of the collections. The policies hold the rules of all collections,
+// so they are only locked while they are read, modified and written back.
+func (t *Twistlock) syncPolicies(ctx context.Context, collections map[string]*TwistlockCollection) error {
+	if len(collections) == 0 {
+		return nil
 	}
+	var keys []string
+	for _, kind := range t.policies.kinds {
+		keys = append(keys, "policy/"+kind.name)
+	}
+	unlock := t.locks.lock(keys...)
+	defer unlock()
+	return t.policies.sync(ctx, t.templates, collections)
+}
 
-	var rb *rbacv1.RoleBinding
-	err = json.Unmarshal(etcdObj.Kvs[0].Value, &rb)
+// groupFields are the group fields kept in sync with the group template
+var groupFields = []string{"role", "ldapGroup", "samlGroup", "oidcGroup", "collections"}
+
+// renderGroup renders the group template and returns its fields
+func (t *Twistlock) renderGroup(twgroup TwistlockGroup) (map[string]json.RawMessage, error) {
+	fields, err := t.templates.renderGroup(twgroup)
 	if err != nil {
-		logrus.Warn("Unable to unmarshal rolebinding: ", err)
-	}
-	role := getRolebinding(rb, "delete")
-
-	for _, cn := range role.CN {
-		twcoll := TwistlockCollection{
-			CN:        cn,
-			Namespace: role.Namespace,
-		}
-		if role.Role == "devOps" {
-			collBytes := gettwAPI(twcollAPI)
-			if len(collBytes) > 0 {
-				var collections []CollectionAPI
-				err := json.Unmarshal(collBytes, &collections)
-				if err != nil {
-					logrus.Warn(err)
-				}
-				for i := 0; i < len(collections); i++ {
-					if collections[i].Name == twcoll.CN {
-						ns := len(collections[i].Namespaces)
-
-						if ns <= 1 && sliceContains(collections[i].Namespaces, twcoll.Namespace) {
-							logrus.Infof("%s is the only namespace in collection %s", twcoll.Namespace, collections[i].Name)
-							logrus.Infof("Deleting Group %s", twcoll.CN)
-							deletetwAPI(twgrpAPI, twcoll.CN)
-							logrus.Infof("Deleting collection %s", twcoll.CN)
-							deletetwAPI(twcollAPI, twcoll.CN)
-						} else if ns > 1 && sliceContains(collections[i].Namespaces, twcoll.Namespace) {
-							logrus.Infof("Removing namespace %s from collection %s", twcoll.Namespace, collections[i].Name)
-							collections[i].Namespaces = sliceRemove(collections[i].Namespaces, twcoll.Namespace)
-							data, _ := json.Marshal(collections[i])
-							modifytwAPI(twcollAPI, collections[i].Name, string(data))
-						}
-						_, err := kvDel(etcdKey)
-						if err != nil {
-							logrus.Warnf("Unable to delete %s from etcd cluster", etcdKey)
-						} else {
-							logrus.Info("Rolebinding deleted successfully from etcd cluster with key ", etcdKey)
-						}
-					}
-				}
+		return nil, fmt.Errorf("Unable to render group %s: %v", twgroup.CN, err)
+	}
+	return fields, nil
+}
+
+// groupCollections returns the collections a group should reference: the desired ones,
+// plus the ones neither touched by the event nor managed by this controller
+func (t *Twistlock) groupCollections(existing *GroupAPI, collections []CollectionAPI, touched []string, want []string) []string {
+	var names []string
+	for _, name := range existing.Collections {
+		if sliceContains(want, name) || sliceContains(names, name) {
+			continue
+		}
+		if sliceContains(touched, name) {
+			logrus.Infof("Removing collection %s from group %s", name, existing.GroupName)
+			continue
+		}
+		// collections of this cluster the group lost access to
+		if coll := findCollection(collections, name); len(t.mapper.Cluster) > 0 && coll != nil && sliceContains(coll.Clusters, t.mapper.Cluster) {
+			logrus.Infof("Removing collection %s from group %s", name, existing.GroupName)
+			continue
+		}
+		names = append(names, name)
+	}
+	for _, name := range want {
+		if !sliceContains(existing.Collections, name) {
+			logrus.Infof("Adding collection %s to group %s", name, existing.GroupName)
+		}
+		names = append(names, name)
+	}
+	return names
+}
 
+// syncGroup converges a group to the desired state: its role, identity flags and collections
+// have to match the group template, all other fields are sent back as received.
+// The group is created with its first and deleted with its last collection on any cluster.
+// It returns an error if the console is unavailable.
+func (t *Twistlock) syncGroup(ctx context.Context, groups []GroupAPI, collections []CollectionAPI, cn string, touched []string, desired *syncScope) error {
+	want := desired.groups[cn]
+
+	var existing *GroupAPI
+	for i := range groups {
+		if groups[i].GroupName == cn {
+			existing = &groups[i]
+			break
+		}
+	}
+
+	twgroup := TwistlockGroup{
+		CN:          cn,
+		Group:       desired.dns[cn],
+		Role:        "devOps",
+		Cluster:     t.mapper.Cluster,
+		Collections: want,
+	}
+	for _, name := range want {
+		for _, ns := range desired.collections[name] {
+			if !sliceContains(twgroup.Namespaces, ns) {
+				twgroup.Namespaces = append(twgroup.Namespaces, ns)
 			}
 		}
 	}
+	t.identity.flags(&twgroup)
+
+	if existing == nil {
+		if len(want) == 0 {
+			return nil
+		}
+		rendered, err := t.renderGroup(twgroup)
+		if err != nil {
+			logrus.Warn(err)
+			return nil
+		}
+		data, _ := json.Marshal(rendered)
+		logrus.Infof("Creating Group %s", cn)
+		if err := posttwAPI(ctx, twgrpAPI, string(data)); err != nil {
+			logrus.Info("Unable to post group")
+			t.console.invalidate()
+			return err
+		}
+		logrus.Info("Group posted successfully")
+		t.console.storeGroup(data)
+		return nil
+	}
+
+	logrus.Infof("Group %s already exists", existing.GroupName)
+	twgroup.Collections = t.groupCollections(existing, collections, touched, want)
+	// collections of other clusters sharing the console keep the group alive
+	if len(twgroup.Collections) == 0 {
+		logrus.Infof("Deleting Group %s", cn)
+		if err := deletetwAPI(ctx, twgrpAPI, existing.ID); err != nil {
+			t.console.invalidate()
+			return err
+		}
+		t.console.removeGroup(cn)
+		return nil
+	}
+
+	rendered, err := t.renderGroup(twgroup)
+	if err != nil {
+		logrus.Warn(err)
+		return nil
+	}
+	update := map[string]json.RawMessage{}
+	var changed []string
+	for _, f := range groupFields {
+		v, ok := rendered[f]
+		if !ok {
+			continue
+		}
+		update[f] = v
+		if !sameField(existing.raw[f], v) {
+			changed = append(changed, f)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	logrus.Infof("Updating fields %v of group %s", changed, cn)
+	data, err := mergeFields(existing.raw, update)
+	if err != nil {
+		logrus.Warn(err)
+		return nil
+	}
+	if err := modifytwAPI(ctx, twgrpAPI, existing.ID, string(data)); err != nil {
+		t.console.invalidate()
+		return err
+	}
+	t.console.storeGroup(data)
+	return nil
 }
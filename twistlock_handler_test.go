@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestTwistlockLastState(t *testing.T) {
+	kv := useFakeKV()
+	ctx := context.Background()
+	tw := &Twistlock{}
+
+	stored := groupRoleBinding("ns1", "rb", "edit", "team-a")
+	data, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored by earlier versions under the plain namespace/name key
+	if _, err := kvPut(ctx, "ns1/rb", string(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, err := tw.LastState(ctx, "pods", "ns1/rb"); err != nil || obj != nil {
+		t.Errorf("got state %v, %v of another resource, want none", obj, err)
+	}
+	obj, err := tw.LastState(ctx, rolebindingResourceName, "ns1/rb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb, ok := obj.(*rbacv1.RoleBinding); !ok || !reflect.DeepEqual(rb.Subjects, stored.Subjects) {
+		t.Errorf("got state %v, want the stored rolebinding", obj)
+	}
+	// the legacy key is moved to the key of the resource
+	if keys := kv.keys("ns1/"); len(keys) != 0 {
+		t.Errorf("legacy keys %v not removed", keys)
+	}
+	if keys := kv.keys(stateKey("ns1", "rb")); len(keys) != 1 {
+		t.Errorf("got keys %v, want %s", keys, stateKey("ns1", "rb"))
+	}
+	if obj, err := tw.LastState(ctx, rolebindingResourceName, "ns1/rb"); err != nil || obj == nil {
+		t.Errorf("got state %v, %v after the move, want the stored rolebinding", obj, err)
+	}
+
+	if obj, err := tw.LastState(ctx, rolebindingResourceName, "ns1/missing"); err != nil || obj != nil {
+		t.Errorf("got state %v, %v of a missing key, want none", obj, err)
+	}
+}
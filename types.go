@@ -1,82 +1,305 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/sirupsen/logrus"
-	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 )
 
 var etcdClient *clientv3.Client
 
 const maxRetries = 10
 
-var serverStartTime time.Time
+// temporaryRetryDelay is the delay before an object failing with a temporary error is retried,
+// temporary errors never exhaust the retries
+const temporaryRetryDelay = 5 * time.Second
+
+const defaultShutdownTimeout = 20 * time.Second
+
 var twc *TwistlockConfig
 
 var configPath *string
 
+var clusterCache *ClusterCache
+
 const twgrpAPI = "/api/v1/groups"
 const twcollAPI = "/api/v1/collections"
 
 // Config struct generated from config.yaml
 type Config struct {
-	Resources struct {
-		Pod                   bool
-		Deployment            bool
-		Replicationcontroller bool
-		Replicaset            bool
-		Daemonset             bool
-		Services              bool
-		Secret                bool
-		Configmap             bool
-		Rolebinding           bool
-	} `yaml:"resources"`
-	Handler struct {
+	Resources ResourceList `yaml:"resources"`
+	Handler   struct {
 		Name string
 	} `yaml:"handler"`
+	Namespaces   NamespaceSelection `yaml:"namespaces"`
+	Rolebindings BindingSelection   `yaml:"rolebindings"`
+	Collections  CollectionConfig   `yaml:"collections"`
+	Cluster      string             `yaml:"cluster"`
+	Identity     IdentityConfig     `yaml:"identity"`
+	Templates    TemplateConfig     `yaml:"templates"`
+	Policies     PolicyConfig       `yaml:"policies"`
+	Alerts       AlertConfig        `yaml:"alerts"`
+	Summaries    SummaryConfig      `yaml:"summaries"`
+	Batching     BatchConfig        `yaml:"batching"`
+	Console      ConsoleConfig      `yaml:"console"`
+	Shutdown     ShutdownConfig     `yaml:"shutdown"`
+}
+
+// TemplateConfig struct, defines where the Twistlock object templates are loaded from
+type TemplateConfig struct {
+	Path           string        `yaml:"path"`
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// IdentityConfig struct, defines how OpenShift groups are translated to console groups
+type IdentityConfig struct {
+	Mode          string            `yaml:"mode"`
+	GroupMapping  map[string]string `yaml:"groupMapping"`
+	GroupTemplate string            `yaml:"groupTemplate"`
+}
+
+// BindingSelection struct, used to restrict the sync to RoleBindings of certain roles
+type BindingSelection struct {
+	RoleRefs       []string `yaml:"roleRefs"`
+	SyncAnnotation string   `yaml:"syncAnnotation"`
+}
+
+// NamespaceSelection struct, used to include or exclude namespaces from the sync
+type NamespaceSelection struct {
+	Include        NamespaceSelector `yaml:"include"`
+	Exclude        NamespaceSelector `yaml:"exclude"`
+	SyncAnnotation string            `yaml:"syncAnnotation"`
+}
+
+// NamespaceSelector struct, matches namespaces by label selector, glob names or regex patterns
+type NamespaceSelector struct {
+	LabelSelector string   `yaml:"labelSelector"`
+	Names         []string `yaml:"names"`
+	Patterns      []string `yaml:"patterns"`
+}
+
+// CollectionConfig struct, defines how collections are mapped and which of their fields are managed
+type CollectionConfig struct {
+	CollectionMapping `yaml:",inline"`
+	OwnedFields       []string       `yaml:"ownedFields"`
+	ConflictPolicy    string         `yaml:"conflictPolicy"`
+	Metadata          MetadataConfig `yaml:"metadata"`
+	Scoping           ScopingConfig  `yaml:"scoping"`
+}
+
+// PolicyConfig struct, enables the vulnerability and compliance rules derived from namespace annotations
+type PolicyConfig struct {
+	Enabled       bool              `yaml:"enabled"`
+	RulePrefix    string            `yaml:"rulePrefix"`
+	Vulnerability PolicyAnnotations `yaml:"vulnerability"`
+	Compliance    PolicyAnnotations `yaml:"compliance"`
+}
+
+// PolicyAnnotations struct, defines the namespace annotations holding the alert and block severity of a policy
+type PolicyAnnotations struct {
+	AlertAnnotation string `yaml:"alertAnnotation"`
+	BlockAnnotation string `yaml:"blockAnnotation"`
+}
+
+// AlertConfig struct, enables the alert profiles routing the alerts of a collection to the team's webhook
+type AlertConfig struct {
+	Enabled                 bool   `yaml:"enabled"`
+	ProfilePrefix           string `yaml:"profilePrefix"`
+	WebhookAnnotation       string `yaml:"webhookAnnotation"`
+	WebhookSecretAnnotation string `yaml:"webhookSecretAnnotation"`
+}
+
+// SummaryConfig struct, enables the scan summaries written back to the namespaces
+type SummaryConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ResourceList is the list of watched resources, see UnmarshalYAML for the legacy map of booleans
+type ResourceList []ResourceConfig
+
+// ResourceConfig struct, a watched resource and the handler its events are sent to
+type ResourceConfig struct {
+	Group    string `yaml:"group"`
+	Version  string `yaml:"version"`
+	Resource string `yaml:"resource"`
+	// name of the handler, defaults to handler.name
+	Handler string `yaml:"handler"`
+	// number of objects processed in parallel, defaults to 1
+	Workers int `yaml:"workers"`
+	// interval in which all objects are passed to the handler again to correct drift, 0 disables resyncs
+	ResyncPeriod time.Duration `yaml:"resyncPeriod"`
+	// only objects matching the selectors are watched and cached
+	LabelSelector string `yaml:"labelSelector"`
+	FieldSelector string `yaml:"fieldSelector"`
+}
+
+// BatchConfig struct, defines how long the changes of a collection are collected before the console is updated
+type BatchConfig struct {
+	// 0 updates the console on every event
+	Window   time.Duration `yaml:"window"`
+	MaxDelay time.Duration `yaml:"maxDelay"`
+}
+
+// ShutdownConfig struct, defines how long the controller drains its work on SIGTERM
+type ShutdownConfig struct {
+	// keys still in process after the timeout are aborted and replayed on the next start
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ConsoleConfig struct, defines how the console collections and groups are cached
+// and how the requests to the console are limited and retried
+type ConsoleConfig struct {
+	RefreshInterval   time.Duration `yaml:"refreshInterval"`
+	PageSize          int           `yaml:"pageSize"`
+	RequestsPerSecond float64       `yaml:"requestsPerSecond"`
+	Burst             int           `yaml:"burst"`
+	Retries           int           `yaml:"retries"`
+	MinBackoff        time.Duration `yaml:"minBackoff"`
+	MaxBackoff        time.Duration `yaml:"maxBackoff"`
+	BreakerThreshold  int           `yaml:"breakerThreshold"`
+	BreakerTimeout    time.Duration `yaml:"breakerTimeout"`
+}
+
+// ScopingConfig struct, defines the namespace annotations narrowing the scope of a collection
+type ScopingConfig struct {
+	LabelsAnnotation     string `yaml:"labelsAnnotation"`
+	ImagesAnnotation     string `yaml:"imagesAnnotation"`
+	ContainersAnnotation string `yaml:"containersAnnotation"`
+	RegistryImages       bool   `yaml:"registryImages"`
+	InternalRegistry     string `yaml:"internalRegistry"`
+	RegistriesAnnotation string `yaml:"registriesAnnotation"`
+	// resolve the node selectors of the namespaces to the hosts of their collections
+	NodeHosts              bool   `yaml:"nodeHosts"`
+	NodeSelectorAnnotation string `yaml:"nodeSelectorAnnotation"`
+}
+
+// MetadataConfig struct, defines the project metadata used for the collection description and color
+type MetadataConfig struct {
+	DisplayNameAnnotation string `yaml:"displayNameAnnotation"`
+	RequesterAnnotation   string `yaml:"requesterAnnotation"`
+	TeamLabel             string `yaml:"teamLabel"`
+}
+
+// CollectionMapping struct, defines how group bindings are mapped to Twistlock Collections
+type CollectionMapping struct {
+	Strategy     string `yaml:"strategy" json:"strategy"`
+	NameTemplate string `yaml:"nameTemplate" json:"nameTemplate"`
+	// Cluster is set from the top level cluster identifier
+	Cluster string `yaml:"-" json:"cluster"`
 }
 
 // Handler is implemented by any handler.
 // The Handle method is used to process event
 type Handler interface {
 	Init(c Config) error
-	ObjectCreated(obj interface{})
-	ObjectDeleted(obj interface{})
-	ObjectUpdated(obj interface{})
+	ObjectCreated(ctx context.Context, obj interface{}) error
+	ObjectDeleted(ctx context.Context, obj interface{}) error
+	ObjectUpdated(ctx context.Context, oldObj, newObj interface{}) error
+}
+
+// errDeferred is returned by handlers completing an event later, like the batching Twistlock handler.
+// They call the completion passed with the context once the event is done, the key stays queued until then.
+var errDeferred = errors.New("event deferred")
+
+// completion completes a deferred event with nil or the error that failed it
+type completion func(error)
+
+// SyncHandler is implemented by handlers that need to act once the informer cache is synced,
+// before the first event is processed
+type SyncHandler interface {
+	CacheSynced(ctx context.Context)
+}
+
+// ShutdownHandler is implemented by handlers holding work in memory,
+// it is called on shutdown once the workers stopped
+type ShutdownHandler interface {
+	Shutdown(ctx context.Context) error
+}
+
+// PausingHandler is implemented by handlers that depend on an external service,
+// the workers stop taking keys off the queue while the handler is paused
+type PausingHandler interface {
+	// Paused returns how long the handler stays paused, 0 if it is not paused
+	Paused() time.Duration
+}
+
+// StatefulHandler is implemented by handlers that store the objects they processed,
+// the controller compares the current state of an object with the stored one.
+// For other handlers the controller keeps the last state in memory.
+type StatefulHandler interface {
+	// LastState returns the stored object of a resource and namespace/name key, nil if it is not stored
+	LastState(ctx context.Context, resource string, key string) (interface{}, error)
 }
 
-// Event indicate the informerEvent
-type Event struct {
-	key          string
-	eventType    string
-	namespace    string
-	resourceType string
-	newObj       *rbacv1.RoleBinding
-	oldObj       *rbacv1.RoleBinding
+// IndexingHandler is implemented by handlers looking up rolebindings by their own indexes,
+// the indexes are added to the rolebinding informer before it is started
+type IndexingHandler interface {
+	Indexers() cache.Indexers
+}
+
+// QueueItem is a queued key as stored on the etcd cluster
+type QueueItem struct {
+	Resource string    `json:"resource"`
+	Key      string    `json:"key"`
+	Resync   bool      `json:"resync,omitempty"`
+	Enqueued time.Time `json:"enqueued"`
+	// set for dead letters
+	Attempts int        `json:"attempts,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Failed   *time.Time `json:"failed,omitempty"`
 }
 
 // Controller struct
 type Controller struct {
 	logger       *logrus.Entry
+	resource     string
+	workers      int
 	clientset    kubernetes.Interface
-	queue        workqueue.RateLimitingInterface
+	queue        *persistentQueue
 	informer     cache.SharedIndexInformer
 	eventHandler Handler
+	nsFilter     *namespaceFilter
+	rbFilter     *bindingFilter
+	mu           sync.Mutex
+	// last state of the objects for handlers that do not store them
+	state map[string]interface{}
+	// keys passed to the handler on the next processing even if unchanged
+	resync map[string]bool
+}
+
+// ClusterCache holds the informer caches used to compute the desired Twistlock state
+type ClusterCache struct {
+	client       kubernetes.Interface
+	namespaces   listersv1.NamespaceLister
+	rolebindings rbaclisters.RoleBindingLister
+	// rolebindings by the indexes of the handler
+	bindings cache.Indexer
+	nodes    listersv1.NodeLister
+	nsFilter *namespaceFilter
+	rbFilter *bindingFilter
 }
 
 // Rolebinding struct, used to create a Twistlock Collection and Group
 type Rolebinding struct {
-	Name      string
-	Namespace string
-	Group     []string
-	CN        []string
-	Action    string
-	Role      string
+	Name        string
+	Namespace   string
+	Group       []string
+	CN          []string
+	Action      string
+	Role        string
+	RoleRef     string
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 // TwistlockConfig struct, used to make API calls to console
@@ -88,15 +311,79 @@ type TwistlockConfig struct {
 
 // TwistlockGroup struct, used to generate a Group json object
 type TwistlockGroup struct {
-	CN    string
-	Group string
-	Role  string
+	CN          string
+	Group       string
+	Role        string
+	Cluster     string
+	Collections []string
+	Namespaces  []string
+	LdapGroup   bool
+	SamlGroup   bool
+	OidcGroup   bool
 }
 
 // TwistlockCollection struct, used to generate a Collection json object
 type TwistlockCollection struct {
-	CN        string
-	Namespace string
+	Name    string
+	Cluster string
+	// CN and DN of the group if a single group maps to the collection
+	CN     string
+	Group  string
+	Groups []string
+	// Namespace is the first of the collection's namespaces
+	Namespace         string
+	Namespaces        []string
+	NamespaceMetadata map[string]TemplateNamespace
+	RoleBindings      []TemplateRoleBinding
+	// derived from the project metadata of the namespaces
+	DisplayNames []string
+	Requesters   []string
+	Team         string
+	Color        string
+	Description  string
+	// derived from the scoping annotations of the namespaces
+	Labels     []string
+	Images     []string
+	Containers []string
+	Hosts      []string
+}
+
+// TwistlockRule struct, used to render the policy rules of a collection
+type TwistlockRule struct {
+	Name       string
+	Collection string
+	Cluster    string
+	Namespaces []string
+	// console threshold values (low 1, medium 4, high 7, critical 9), 0 if not set
+	AlertThreshold int
+	BlockThreshold int
+	AlertSeverity  string
+	BlockSeverity  string
+}
+
+// TwistlockAlertProfile struct, used to render the alert profile of a collection
+type TwistlockAlertProfile struct {
+	Name       string
+	Collection string
+	Cluster    string
+	Namespaces []string
+	WebhookURL string
+}
+
+// TemplateNamespace struct, the namespace metadata passed to the templates
+type TemplateNamespace struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// TemplateRoleBinding struct, the RoleBinding metadata passed to the templates
+type TemplateRoleBinding struct {
+	Name        string
+	Namespace   string
+	RoleRef     string
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 // CollectionAPI needed to get JSON object from API
@@ -109,9 +396,12 @@ type CollectionAPI struct {
 	Hosts       []string `json:"hosts"`
 	Labels      []string `json:"labels"`
 	Services    []string `json:"services"`
-	Functions   []string `json:"funtions"`
+	Functions   []string `json:"functions"`
 	Namespaces  []string `json:"namespaces"`
 	AppIDs      []string `json:"appIDs"`
+	Clusters    []string `json:"clusters"`
+	// raw holds all fields as returned by the console
+	raw map[string]json.RawMessage
 }
 
 // GroupAPI needed to get JSON object from API
@@ -122,9 +412,28 @@ type GroupAPI struct {
 	Owner        string   `json:"owner"`
 	LdapGroup    bool     `json:"ldapGroup"`
 	SamlGroup    bool     `json:"samlGroup"`
+	OidcGroup    bool     `json:"oidcGroup"`
 	Role         string   `json:"role"`
 	ID           string   `json:"_id"`
 	Projects     []string `json:"projects"`
 	GroupID      string   `json:"groupId"`
 	Collections  []string `json:"collections"`
+	// raw holds all fields as returned by the console
+	raw map[string]json.RawMessage
+}
+
+// ImageAPI struct, the scan result of an image
+type ImageAPI struct {
+	ScanTime                  time.Time            `json:"scanTime"`
+	VulnerabilityDistribution SeverityDistribution `json:"vulnerabilityDistribution"`
+	ComplianceDistribution    SeverityDistribution `json:"complianceDistribution"`
+}
+
+// SeverityDistribution struct, the number of findings by severity
+type SeverityDistribution struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Total    int `json:"total"`
 }
@@ -3,42 +3,56 @@ package main
 import (
 	"errors"
 	"os"
+	"sort"
 
 	"github.com/sirupsen/logrus"
-	appsv1 "k8s.io/api/apps/v1"
-	batchv1 "k8s.io/api/batch/v1"
-	apiv1 "k8s.io/api/core/v1"
-	extv1beta1 "k8s.io/api/extensions/v1beta1"
-	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func getClient() (*kubernetes.Clientset, error) {
-	var config *rest.Config
-	var err error
+func getRestConfig() (*rest.Config, error) {
 	_, configexists := os.LookupEnv("KUBECONFIG")
 
 	if configexists {
 		logrus.Info("Loading kubeconfig", os.Getenv("KUBECONFIG"))
-		config, err = clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+		config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
 		if err != nil {
 			panic(err.Error())
 		}
 		logrus.Infof("Kubeconfig %s initialized", os.Getenv("KUBECONFIG"))
-	} else {
-		logrus.Info("Loading ServiceAccount token")
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-		logrus.Infof("ServiceAccount token initialized")
+		return config, nil
+	}
+	logrus.Info("Loading ServiceAccount token")
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		panic(err.Error())
+	}
+	logrus.Infof("ServiceAccount token initialized")
+	return config, nil
+}
+
+func getClient() (*kubernetes.Clientset, error) {
+	config, err := getRestConfig()
+	if err != nil {
+		return nil, err
 	}
 	return kubernetes.NewForConfig(config)
 }
 
+// getDynamicClient returns a client for resources without generated types, e.g. custom resources
+func getDynamicClient() (dynamic.Interface, error) {
+	config, err := getRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
 func getTwistlockConfig() (*TwistlockConfig, error) {
 	twUser, ok := os.LookupEnv("TWISTLOCK_USER")
 	if !ok {
@@ -64,36 +78,14 @@ func getTwistlockConfig() (*TwistlockConfig, error) {
 	return nil, errors.New("Could not get Twistlock config")
 }
 
-// GetObjectMetaData returns metadata of a given k8s object
-func GetObjectMetaData(obj interface{}) metav1.ObjectMeta {
-
-	var objectMeta metav1.ObjectMeta
-
-	switch object := obj.(type) {
-	case *rbacv1.RoleBinding:
-		objectMeta = object.ObjectMeta
-	case *appsv1.Deployment:
-		objectMeta = object.ObjectMeta
-	case *apiv1.ReplicationController:
-		objectMeta = object.ObjectMeta
-	case *appsv1.ReplicaSet:
-		objectMeta = object.ObjectMeta
-	case *appsv1.DaemonSet:
-		objectMeta = object.ObjectMeta
-	case *apiv1.Service:
-		objectMeta = object.ObjectMeta
-	case *apiv1.Pod:
-		objectMeta = object.ObjectMeta
-	case *batchv1.Job:
-		objectMeta = object.ObjectMeta
-	case *apiv1.PersistentVolume:
-		objectMeta = object.ObjectMeta
-	case *apiv1.Namespace:
-		objectMeta = object.ObjectMeta
-	case *apiv1.Secret:
-		objectMeta = object.ObjectMeta
-	case *extv1beta1.Ingress:
-		objectMeta = object.ObjectMeta
+// GetObjectMetaData returns metadata of a given k8s object, including objects of deleted tombstones
+func GetObjectMetaData(obj interface{}) metav1.Object {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	objectMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return &metav1.ObjectMeta{}
 	}
 	return objectMeta
 }
@@ -115,3 +107,12 @@ func sliceRemove(s []string, r string) []string {
 	}
 	return s
 }
+
+func mapKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}